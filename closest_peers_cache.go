@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// closestPeersCache remembers the peers that responded to the last completed lookup in every key region, i.e. for
+// every prefix of regionBits bits of the Kademlia IDs of the lookup targets, so that later lookups for keys of the
+// same region can start from them.
+type closestPeersCache struct {
+	ttl        time.Duration
+	regionBits int
+
+	mu      sync.Mutex
+	regions map[string]closestPeersEntry
+}
+
+type closestPeersEntry struct {
+	peers   []peer.AddrInfo
+	expires time.Time
+}
+
+func newClosestPeersCache(ttl time.Duration, regionBits int) *closestPeersCache {
+	return &closestPeersCache{
+		ttl:        ttl,
+		regionBits: regionBits,
+		regions:    make(map[string]closestPeersEntry),
+	}
+}
+
+// region returns the first regionBits bits of the Kademlia ID, the remaining bits of the last byte cleared.
+func (c *closestPeersCache) region(id kb.ID) string {
+	n := (c.regionBits + 7) / 8
+	r := make([]byte, n)
+	copy(r, id)
+	if rem := c.regionBits % 8; rem != 0 {
+		r[n-1] &= byte(0xff << (8 - rem))
+	}
+	return string(r)
+}
+
+// add replaces the peers of the region of the Kademlia ID.
+func (c *closestPeersCache) add(id kb.ID, peers []peer.AddrInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for r, e := range c.regions {
+		if now.After(e.expires) {
+			delete(c.regions, r)
+		}
+	}
+	c.regions[c.region(id)] = closestPeersEntry{peers: peers, expires: now.Add(c.ttl)}
+}
+
+// get returns the peers of the region of the Kademlia ID, nil if there are none or they expired.
+func (c *closestPeersCache) get(id kb.ID) []peer.AddrInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.regions[c.region(id)]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	return e.peers
+}
+
+// cacheClosestPeers remembers the peers that responded to a completed lookup for the target.
+func (dht *IpfsDHT) cacheClosestPeers(target string, lookupRes *lookupWithFollowupResult) {
+	if dht.closestPeersCache == nil || !lookupRes.completed {
+		return
+	}
+
+	peers := make([]peer.AddrInfo, 0, len(lookupRes.peers))
+	for i, p := range lookupRes.peers {
+		if lookupRes.state[i] == qpeerset.PeerQueried {
+			peers = append(peers, dht.peerstore.PeerInfo(p))
+		}
+	}
+	if len(peers) > 0 {
+		dht.closestPeersCache.add(kb.ConvertKey(target), peers)
+	}
+}
+
+// nearestSeedPeers returns the bucketSize peers closest to the target among the routing table and the cached peers
+// of the target's region.
+func (dht *IpfsDHT) nearestSeedPeers(target kb.ID) []peer.ID {
+	nearest := dht.routingTable.NearestPeers(target, dht.bucketSize)
+	if dht.closestPeersCache == nil {
+		return nearest
+	}
+	cached := dht.closestPeersCache.get(target)
+	if len(cached) == 0 {
+		return nearest
+	}
+
+	seeds := make([]peer.AddrInfo, 0, len(cached)+len(nearest))
+	seeds = append(seeds, cached...)
+	for _, p := range nearest {
+		seeds = append(seeds, peer.AddrInfo{ID: p})
+	}
+	ids := dht.seedPeers(seeds, target)
+	if len(ids) > dht.bucketSize {
+		ids = ids[:dht.bucketSize]
+	}
+	return ids
+}
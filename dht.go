@@ -8,6 +8,7 @@ package dht
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p-kad-dht/rtrefresh"
@@ -67,6 +69,10 @@ const (
 
 const (
 	kad1 protocol.ID = "/kad/1.0.0"
+
+	// pipelinedSuffix is appended to the primary protocol to form the protocol used for pipelined streams, on which
+	// multiple requests can be in flight at once and responses are matched to requests by their request ID.
+	pipelinedSuffix protocol.ID = "/pipelined"
 )
 
 const (
@@ -104,8 +110,21 @@ type IpfsDHT struct {
 	proc goprocess.Process
 
 	strmap map[peer.ID]*messageSender
+	strlru *list.List // the message senders in strmap, most recently used first
 	smlk   sync.Mutex
 
+	smStats    messageSenderCounters // protected by smlk
+	smReopened uint64                // accessed atomically
+
+	maxMessageSenders        int
+	messageSenderIdleTimeout time.Duration
+	streamReuseTries         int
+
+	readMessageTimeout        time.Duration
+	readMessageTimeoutForType map[pb.Message_MessageType]time.Duration
+	adaptiveReadTimeout       adaptiveTimeout
+	streamIdleTimeout         time.Duration
+
 	plk sync.Mutex
 
 	stripedPutLocks [256]sync.Mutex
@@ -118,6 +137,10 @@ type IpfsDHT struct {
 	// DHT protocols we can respond to.
 	serverProtocols []protocol.ID
 
+	// pipelinedProtocol is the protocol we prefer when opening streams to peers that support request pipelining.
+	// It is empty if request pipelining is disabled.
+	pipelinedProtocol protocol.ID
+
 	auto   ModeOpt
 	mode   mode
 	modeLk sync.Mutex
@@ -126,6 +149,29 @@ type IpfsDHT struct {
 	alpha      int // The concurrency parameter per path
 	beta       int // The number of peers closest to a target that must have responded for a query path to terminate
 
+	disjointPaths int // The number of disjoint paths a lookup is split into
+
+	queryLatencies  *queryLatencyModel
+	hedgePercentile float64 // The percentile of a peer's query durations after which a query is hedged, 0 if disabled
+
+	nsEstimator *netsize.Estimator
+
+	enableOptimisticProvide      bool
+	optimisticProvideReturnRatio float64
+
+	enableLookupSharing bool
+	sharedLookups       *sharedLookups
+	valueWatchers       *valueWatchers
+	closestPeersCache   *closestPeersCache // nil if disabled
+	negativeCache       *negativeCache     // nil if disabled
+
+	readRepairer *readRepairer
+	staleValues  staleValueCounts
+
+	publicKeyRepublishInterval time.Duration // 0 if the public key isn't published
+	publicKeys                 *publicKeyCache
+	largeValueChunkSize        int
+
 	queryPeerFilter        QueryFilterFunc
 	routingTablePeerFilter RouteTableFilterFunc
 	rtPeerDiversityFilter  peerdiversity.PeerIPGroupFilter
@@ -197,6 +243,9 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 
 	dht.Validator = cfg.validator
 
+	dht.publicKeyRepublishInterval = cfg.publicKeyRepublishInterval
+	dht.largeValueChunkSize = cfg.largeValueChunkSize
+
 	dht.testAddressUpdateProcessing = cfg.testAddressUpdateProcessing
 
 	dht.auto = cfg.mode
@@ -232,6 +281,25 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 
 	dht.proc.Go(dht.rtPeerLoop)
 
+	if dht.messageSenderIdleTimeout > 0 {
+		dht.proc.Go(dht.reapIdleMessageSenders)
+	}
+	if dht.negativeCache != nil {
+		dht.proc.Go(dht.sweepNegativeCache)
+	}
+	if dht.publicKeys.negativeTTL > 0 {
+		dht.proc.Go(dht.sweepPublicKeyFailures)
+	}
+
+	if dht.enableValues {
+		if err := dht.storeSelfPublicKey(); err != nil {
+			logger.Warnw("failed to store own public key record", "error", err)
+		}
+		if dht.publicKeyRepublishInterval > 0 {
+			dht.proc.Go(dht.publishPublicKeyLoop)
+		}
+	}
+
 	return dht, nil
 }
 
@@ -269,6 +337,12 @@ func makeDHT(ctx context.Context, h host.Host, cfg config) (*IpfsDHT, error) {
 	protocols = []protocol.ID{v1proto}
 	serverProtocols = []protocol.ID{v1proto}
 
+	var pipelinedProto protocol.ID
+	if cfg.enableRequestPipelining {
+		pipelinedProto = v1proto + pipelinedSuffix
+		serverProtocols = append(serverProtocols, pipelinedProto)
+	}
+
 	dht := &IpfsDHT{
 		datastore:              cfg.datastore,
 		self:                   h.ID(),
@@ -276,23 +350,56 @@ func makeDHT(ctx context.Context, h host.Host, cfg config) (*IpfsDHT, error) {
 		peerstore:              h.Peerstore(),
 		host:                   h,
 		strmap:                 make(map[peer.ID]*messageSender),
+		strlru:                 list.New(),
 		birth:                  time.Now(),
 		protocols:              protocols,
 		protocolsStrs:          protocol.ConvertToStrings(protocols),
 		serverProtocols:        serverProtocols,
+		pipelinedProtocol:      pipelinedProto,
 		bucketSize:             cfg.bucketSize,
 		alpha:                  cfg.concurrency,
 		beta:                   cfg.resiliency,
+		disjointPaths:          cfg.disjointPaths,
 		queryPeerFilter:        cfg.queryPeerFilter,
 		routingTablePeerFilter: cfg.routingTable.peerFilter,
 		rtPeerDiversityFilter:  cfg.routingTable.diversityFilter,
 
+		maxMessageSenders:        cfg.messageSenders.maxSenders,
+		messageSenderIdleTimeout: cfg.messageSenders.idleTimeout,
+		streamReuseTries:         cfg.messageSenders.streamReuseTries,
+
+		readMessageTimeout:        cfg.timeouts.readMessage,
+		readMessageTimeoutForType: cfg.timeouts.readMessageForType,
+		adaptiveReadTimeout:       cfg.timeouts.adaptiveRead,
+		streamIdleTimeout:         cfg.timeouts.streamIdle,
+
+		nsEstimator:                  netsize.NewEstimator(cfg.bucketSize, netsize.DefaultMaxMeasurements, netsize.DefaultHalfLife),
+		queryLatencies:               newQueryLatencyModel(),
+		hedgePercentile:              cfg.hedgePercentile,
+		enableOptimisticProvide:      cfg.optimisticProvide.enabled,
+		optimisticProvideReturnRatio: cfg.optimisticProvide.returnRatio,
+
+		enableLookupSharing: cfg.enableLookupSharing,
+		sharedLookups:       newSharedLookups(),
+		valueWatchers:       newValueWatchers(),
+
 		fixLowPeersChan: make(chan struct{}, 1),
 
 		addPeerToRTChan:   make(chan addPeerRTReq),
 		refreshFinishedCh: make(chan struct{}),
 	}
 
+	if cfg.closestPeersCache.ttl > 0 {
+		dht.closestPeersCache = newClosestPeersCache(cfg.closestPeersCache.ttl, cfg.closestPeersCache.regionBits)
+	}
+	if cfg.negativeCacheTTL > 0 {
+		dht.negativeCache = newNegativeCache(cfg.negativeCacheTTL)
+	}
+	dht.readRepairer = newReadRepairer(cfg.readRepair, cfg.timeouts.readRepair)
+	dht.publicKeys = newPublicKeyCache(cfg.publicKeys.negativeTTL, cfg.publicKeys.concurrency)
+	dht.staleValues.counts = make(map[peer.ID]int)
+	dht.staleValues.threshold = cfg.staleValueThreshold
+
 	var maxLastSuccessfulOutboundThreshold time.Duration
 
 	// The threshold is calculated based on the expected amount of time that should pass before we
@@ -339,7 +446,7 @@ func makeDHT(ctx context.Context, h host.Host, cfg config) (*IpfsDHT, error) {
 	}
 	dht.ProviderManager = pm
 
-	dht.rtFreezeTimeout = rtFreezeTimeout
+	dht.rtFreezeTimeout = cfg.routingTable.freezeTimeout
 
 	return dht, nil
 }
@@ -363,8 +470,12 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg config, maxLastSuccessfulOutboundThr
 		cfg.routingTable.refreshInterval,
 		maxLastSuccessfulOutboundThreshold,
 		dht.refreshFinishedCh)
+	if err != nil {
+		return nil, err
+	}
+	r.SetPeerPingTimeout(cfg.routingTable.peerPingTimeout)
 
-	return r, err
+	return r, nil
 }
 
 func makeRoutingTable(dht *IpfsDHT, cfg config, maxLastSuccessfulOutboundThreshold time.Duration) (*kb.RoutingTable, error) {
@@ -411,6 +522,7 @@ func makeRoutingTable(dht *IpfsDHT, cfg config, maxLastSuccessfulOutboundThresho
 	rt.PeerRemoved = func(p peer.ID) {
 		cmgr.Unprotect(p, kbucketTag)
 		cmgr.UntagPeer(p, kbucketTag)
+		dht.forgetStaleValues(p)
 
 		// try to fix the RT
 		dht.fixRTIfNeeded()
@@ -581,9 +693,9 @@ func (dht *IpfsDHT) getValueOrPeers(ctx context.Context, p peer.ID, key string)
 		err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue())
 		if err != nil {
 			logger.Debug("received invalid record (discarded)")
-			// return a sentinal to signify an invalid record was received
+			// return a sentinal to signify an invalid record was received, along with the record so that callers can
+			// tell which value was invalid
 			err = errInvalidRecord
-			rec = new(recpb.Record)
 		}
 		return rec, peers, err
 	}
@@ -849,6 +961,13 @@ func (dht *IpfsDHT) Process() goprocess.Process {
 	return dht.proc
 }
 
+// NetworkSize returns the estimated number of peers in the DHT network, based on the distances of the closest peers
+// found by recent lookups (including routing table refreshes). It returns netsize.ErrNotEnoughData until enough
+// lookups have completed.
+func (dht *IpfsDHT) NetworkSize() (int, error) {
+	return dht.nsEstimator.NetworkSize()
+}
+
 // RoutingTable returns the DHT's routingTable.
 func (dht *IpfsDHT) RoutingTable() *kb.RoutingTable {
 	return dht.routingTable
@@ -2,14 +2,17 @@ package dht
 
 import (
 	"bufio"
+	"container/list"
 	"context"
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-msgio/protoio"
 
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
@@ -24,6 +27,34 @@ import (
 var dhtReadMessageTimeout = 10 * time.Second
 var dhtStreamIdleTimeout = 1 * time.Minute
 
+// adaptiveTimeout derives a read timeout from the latency observed to a peer.
+type adaptiveTimeout struct {
+	enabled    bool
+	multiplier float64
+	min, max   time.Duration
+}
+
+// readTimeout returns how long we wait for peer p to respond to a request of type t. A timeout configured for the type
+// takes precedence over the adaptive timeout.
+func (dht *IpfsDHT) readTimeout(p peer.ID, t pb.Message_MessageType) time.Duration {
+	if timeout, ok := dht.readMessageTimeoutForType[t]; ok {
+		return timeout
+	}
+	if a := dht.adaptiveReadTimeout; a.enabled {
+		if lat := dht.peerstore.LatencyEWMA(p); lat > 0 {
+			timeout := time.Duration(a.multiplier * float64(lat))
+			if timeout < a.min {
+				return a.min
+			}
+			if timeout > a.max {
+				return a.max
+			}
+			return timeout
+		}
+	}
+	return dht.readMessageTimeout
+}
+
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = fmt.Errorf("timed out reading response")
 
@@ -72,6 +103,10 @@ func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 	}
 }
 
+// maxPipelinedRequests is the maximum number of requests we will handle concurrently on a single pipelined stream.
+// Once reached, we stop reading from the stream until one of the outstanding requests has been answered.
+const maxPipelinedRequests = 16
+
 // Returns true on orderly completion of writes (so we can Close the stream).
 func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 	ctx := dht.ctx
@@ -79,9 +114,23 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 
 	mPeer := s.Conn().RemotePeer()
 
-	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { _ = s.Reset() })
+	timer := time.AfterFunc(dht.streamIdleTimeout, func() { _ = s.Reset() })
 	defer timer.Stop()
 
+	// On pipelined streams every request is handled in its own goroutine, so responses may be written out of order.
+	// The request ID lets the remote peer match them up again.
+	var (
+		pipelined = dht.pipelinedProtocol != "" && s.Protocol() == dht.pipelinedProtocol
+		wlk       sync.Mutex // serializes response writes
+		inflight  sync.WaitGroup
+		slots     chan struct{}
+	)
+	if pipelined {
+		slots = make(chan struct{}, maxPipelinedRequests)
+		// don't close the stream before all outstanding requests have been answered.
+		defer inflight.Wait()
+	}
+
 	for {
 		if dht.getMode() != modeServer {
 			logger.Errorf("ignoring incoming dht message while not in server mode")
@@ -128,84 +177,110 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			return false
 		}
 
-		timer.Reset(dhtStreamIdleTimeout)
-
-		startTime := time.Now()
-		ctx, _ := tag.New(ctx,
-			tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
-		)
-
-		stats.Record(ctx,
-			metrics.ReceivedMessages.M(1),
-			metrics.ReceivedBytes.M(int64(msgLen)),
-		)
+		timer.Reset(dht.streamIdleTimeout)
 
-		handler := dht.handlerForMsgType(req.GetType())
-		if handler == nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())))
+		if !pipelined {
+			if !dht.handleRequest(ctx, s, &wlk, mPeer, &req, msgLen) {
+				return false
 			}
-			return false
+			continue
 		}
 
-		// a peer has queried us, let's add it to RT
-		dht.peerFound(dht.ctx, mPeer, true)
+		slots <- struct{}{}
+		inflight.Add(1)
+		go func(req *pb.Message) {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			if !dht.handleRequest(ctx, s, &wlk, mPeer, req, msgLen) {
+				_ = s.Reset()
+			}
+		}(&req)
+	}
+}
+
+// handleRequest handles a single request read from the stream s and writes out the response, if any, while holding
+// wlk.
+// Returns false if the request could not be handled or the response could not be written.
+func (dht *IpfsDHT) handleRequest(ctx context.Context, s network.Stream, wlk *sync.Mutex, mPeer peer.ID, req *pb.Message, msgLen int) bool {
+	startTime := time.Now()
+	ctx, _ = tag.New(ctx,
+		tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
+	)
+
+	stats.Record(ctx,
+		metrics.ReceivedMessages.M(1),
+		metrics.ReceivedBytes.M(int64(msgLen)),
+	)
 
-		if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
+	handler := dht.handlerForMsgType(req.GetType())
+	if handler == nil {
+		stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+		if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
 			c.Write(zap.String("from", mPeer.String()),
-				zap.Int32("type", int32(req.GetType())),
-				zap.Binary("key", req.GetKey()))
-		}
-		resp, err := handler(ctx, mPeer, &req)
-		if err != nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())),
-					zap.Binary("key", req.GetKey()),
-					zap.Error(err))
-			}
-			return false
+				zap.Int32("type", int32(req.GetType())))
 		}
+		return false
+	}
+
+	// a peer has queried us, let's add it to RT
+	dht.peerFound(dht.ctx, mPeer, true)
 
-		if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
+	if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()))
+	}
+	resp, err := handler(ctx, mPeer, req)
+	if err != nil {
+		stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+		if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
 			c.Write(zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", time.Since(startTime)))
-		}
-
-		if resp == nil {
-			continue
+				zap.Error(err))
 		}
+		return false
+	}
 
-		// send out response msg
-		err = writeMsg(s, resp)
-		if err != nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())),
-					zap.Binary("key", req.GetKey()),
-					zap.Error(err))
-			}
-			return false
-		}
+	if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()),
+			zap.Duration("time", time.Since(startTime)))
+	}
 
-		elapsedTime := time.Since(startTime)
+	if resp == nil {
+		return true
+	}
+	resp.RequestId = req.GetRequestId()
 
-		if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
+	// send out response msg
+	wlk.Lock()
+	err = writeMsg(s, resp)
+	wlk.Unlock()
+	if err != nil {
+		stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+		if c := baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
 			c.Write(zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", elapsedTime))
+				zap.Error(err))
 		}
+		return false
+	}
 
-		latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
-		stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+	elapsedTime := time.Since(startTime)
+
+	if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()),
+			zap.Duration("time", elapsedTime))
 	}
+
+	latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
+	stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+	return true
 }
 
 // sendRequest sends out a request, but also makes sure to
@@ -222,6 +297,7 @@ func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message
 		logger.Debugw("request failed to open message sender", "error", err, "to", p)
 		return nil, err
 	}
+	defer dht.releaseMessageSender(ms)
 
 	start := time.Now()
 
@@ -257,6 +333,7 @@ func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message
 		logger.Debugw("message failed to open message sender", "error", err, "to", p)
 		return err
 	}
+	defer dht.releaseMessageSender(ms)
 
 	if err := ms.SendMessage(ctx, pmes); err != nil {
 		stats.Record(ctx,
@@ -274,30 +351,37 @@ func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message
 	return nil
 }
 
+// messageSenderForPeer returns the message sender for peer p, creating it if needed. The message sender is in use
+// until it is released with releaseMessageSender.
 func (dht *IpfsDHT) messageSenderForPeer(ctx context.Context, p peer.ID) (*messageSender, error) {
 	dht.smlk.Lock()
 	ms, ok := dht.strmap[p]
 	if ok {
+		dht.acquireMessageSender(ms)
+		dht.smStats.Reused++
 		dht.smlk.Unlock()
 		return ms, nil
 	}
-	ms = &messageSender{p: p, dht: dht, lk: newCtxMutex()}
-	dht.strmap[p] = ms
+	ms = &messageSender{p: p, dht: dht, lk: newCtxMutex(), inUse: 1}
+	dht.addMessageSender(ms)
+	dht.smStats.Created++
 	dht.smlk.Unlock()
 
 	if err := ms.prepOrInvalidate(ctx); err != nil {
 		dht.smlk.Lock()
 		defer dht.smlk.Unlock()
+		ms.inUse--
 
 		if msCur, ok := dht.strmap[p]; ok {
 			// Changed. Use the new one, old one is invalid and
 			// not in the map so we can just throw it away.
 			if ms != msCur {
+				dht.acquireMessageSender(msCur)
 				return msCur, nil
 			}
 			// Not changed, remove the now invalid stream from the
 			// map.
-			delete(dht.strmap, p)
+			dht.removeMessageSender(p)
 		}
 		// Invalid but not in map. Must have been removed by a disconnect.
 		return nil, err
@@ -313,8 +397,18 @@ type messageSender struct {
 	p   peer.ID
 	dht *IpfsDHT
 
+	// pipeline is set instead of s if the peer accepted a pipelined stream.
+	pipeline *pipelinedStream
+
 	invalid   bool
 	singleMes int
+	opened    bool // whether we ever opened a stream, used to count reopened streams
+
+	// elem is the position of this sender in the LRU list of senders, lastUsed is the last time it was handed out or
+	// released and inUse is the number of requests and messages being sent with it. They are protected by dht.smlk.
+	elem     *list.Element
+	lastUsed time.Time
+	inUse    int
 }
 
 // invalidate is called before this messageSender is removed from the strmap.
@@ -326,6 +420,10 @@ func (ms *messageSender) invalidate() {
 		_ = ms.s.Reset()
 		ms.s = nil
 	}
+	if ms.pipeline != nil {
+		ms.pipeline.fail(fmt.Errorf("message sender has been invalidated"))
+		ms.pipeline = nil
+	}
 }
 
 func (ms *messageSender) prepOrInvalidate(ctx context.Context) error {
@@ -348,14 +446,35 @@ func (ms *messageSender) prep(ctx context.Context) error {
 	if ms.s != nil {
 		return nil
 	}
+	if ms.pipeline != nil {
+		if !ms.pipeline.isClosed() {
+			return nil
+		}
+		ms.pipeline = nil
+	}
 
 	// We only want to speak to peers using our primary protocols. We do not want to query any peer that only speaks
 	// one of the secondary "server" protocols that we happen to support (e.g. older nodes that we can respond to for
 	// backwards compatibility reasons).
-	nstr, err := ms.dht.host.NewStream(ctx, ms.p, ms.dht.protocols...)
+	// If request pipelining is enabled we prefer it, falling back to the primary protocols for peers that don't
+	// support it.
+	protos := ms.dht.protocols
+	if ms.dht.pipelinedProtocol != "" {
+		protos = append([]protocol.ID{ms.dht.pipelinedProtocol}, protos...)
+	}
+	nstr, err := ms.dht.host.NewStream(ctx, ms.p, protos...)
 	if err != nil {
 		return err
 	}
+	if ms.opened {
+		atomic.AddUint64(&ms.dht.smReopened, 1)
+	}
+	ms.opened = true
+
+	if ms.dht.pipelinedProtocol != "" && nstr.Protocol() == ms.dht.pipelinedProtocol {
+		ms.pipeline = newPipelinedStream(nstr)
+		return nil
+	}
 
 	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
 	ms.s = nstr
@@ -363,10 +482,10 @@ func (ms *messageSender) prep(ctx context.Context) error {
 	return nil
 }
 
-// streamReuseTries is the number of times we will try to reuse a stream to a
-// given peer before giving up and reverting to the old one-message-per-stream
-// behaviour.
-const streamReuseTries = 3
+// defaultStreamReuseTries is the default number of times we will try to reuse
+// a stream to a given peer before giving up and reverting to the old
+// one-message-per-stream behaviour.
+const defaultStreamReuseTries = 3
 
 func (ms *messageSender) SendMessage(ctx context.Context, pmes *pb.Message) error {
 	if err := ms.lk.Lock(ctx); err != nil {
@@ -380,6 +499,16 @@ func (ms *messageSender) SendMessage(ctx context.Context, pmes *pb.Message) erro
 			return err
 		}
 
+		if ps := ms.pipeline; ps != nil {
+			err := ps.sendMessage(pmes)
+			if err != nil && !retry {
+				logger.Debugw("error writing message", "error", err, "retrying", true)
+				retry = true
+				continue
+			}
+			return err
+		}
+
 		if err := ms.writeMsg(pmes); err != nil {
 			_ = ms.s.Reset()
 			ms.s = nil
@@ -394,7 +523,7 @@ func (ms *messageSender) SendMessage(ctx context.Context, pmes *pb.Message) erro
 		}
 
 		var err error
-		if ms.singleMes > streamReuseTries {
+		if ms.singleMes > ms.dht.streamReuseTries {
 			err = ms.s.Close()
 			ms.s = nil
 		} else if retry {
@@ -406,16 +535,47 @@ func (ms *messageSender) SendMessage(ctx context.Context, pmes *pb.Message) erro
 }
 
 func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
-	if err := ms.lk.Lock(ctx); err != nil {
-		return nil, err
+	retry := false
+	for {
+		if err := ms.lk.Lock(ctx); err != nil {
+			return nil, err
+		}
+		if err := ms.prep(ctx); err != nil {
+			ms.lk.Unlock()
+			return nil, err
+		}
+
+		ps := ms.pipeline
+		if ps == nil {
+			defer ms.lk.Unlock()
+			return ms.sendRequestLocked(ctx, pmes, retry)
+		}
+
+		// Requests on a pipelined stream are matched to their responses by ID, so we only need to hold the lock
+		// while (re)opening the stream, not for the whole round trip.
+		ms.lk.Unlock()
+		mes, err := ps.sendRequest(ctx, pmes, ms.dht.readTimeout(ms.p, pmes.GetType()))
+		// Only retry if the stream itself broke, not if this one request failed (e.g. timed out).
+		if err != nil && !retry && ps.isClosed() && ctx.Err() == nil {
+			logger.Debugw("error on pipelined stream", "error", err, "retrying", true)
+			retry = true
+			continue
+		}
+		return mes, err
 	}
-	defer ms.lk.Unlock()
+}
 
-	retry := false
+// sendRequestLocked sends a request and waits for the response on a stream that is not pipelined. The caller must
+// hold the lock for the whole round trip.
+func (ms *messageSender) sendRequestLocked(ctx context.Context, pmes *pb.Message, retry bool) (*pb.Message, error) {
 	for {
 		if err := ms.prep(ctx); err != nil {
 			return nil, err
 		}
+		if ms.pipeline != nil {
+			// We reopened the stream and the peer now supports pipelining.
+			return ms.pipeline.sendRequest(ctx, pmes, ms.dht.readTimeout(ms.p, pmes.GetType()))
+		}
 
 		if err := ms.writeMsg(pmes); err != nil {
 			_ = ms.s.Reset()
@@ -431,7 +591,7 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 		}
 
 		mes := new(pb.Message)
-		if err := ms.ctxReadMsg(ctx, mes); err != nil {
+		if err := ms.ctxReadMsg(ctx, mes, ms.dht.readTimeout(ms.p, pmes.GetType())); err != nil {
 			_ = ms.s.Reset()
 			ms.s = nil
 
@@ -445,7 +605,7 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 		}
 
 		var err error
-		if ms.singleMes > streamReuseTries {
+		if ms.singleMes > ms.dht.streamReuseTries {
 			err = ms.s.Close()
 			ms.s = nil
 		} else if retry {
@@ -460,7 +620,7 @@ func (ms *messageSender) writeMsg(pmes *pb.Message) error {
 	return writeMsg(ms.s, pmes)
 }
 
-func (ms *messageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
+func (ms *messageSender) ctxReadMsg(ctx context.Context, mes *pb.Message, timeout time.Duration) error {
 	errc := make(chan error, 1)
 	go func(r msgio.ReadCloser) {
 		defer close(errc)
@@ -473,7 +633,7 @@ func (ms *messageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error
 		errc <- mes.Unmarshal(bytes)
 	}(ms.r)
 
-	t := time.NewTimer(dhtReadMessageTimeout)
+	t := time.NewTimer(timeout)
 	defer t.Stop()
 
 	select {
@@ -485,3 +645,149 @@ func (ms *messageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error
 		return ErrReadTimeout
 	}
 }
+
+// pipelinedStream multiplexes requests to a single peer over one stream. Every request is tagged with a request ID
+// and a background reader hands each response to the request with the matching ID, so multiple requests can be in
+// flight at the same time.
+type pipelinedStream struct {
+	s network.Stream
+
+	wlk sync.Mutex // serializes writes to the stream
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *pb.Message
+	closed  bool
+	err     error // the error that closed the stream
+}
+
+func newPipelinedStream(s network.Stream) *pipelinedStream {
+	ps := &pipelinedStream{
+		s:       s,
+		pending: make(map[uint64]chan *pb.Message),
+	}
+	go ps.readLoop(msgio.NewVarintReaderSize(s, network.MessageSizeMax))
+	return ps
+}
+
+// readLoop dispatches responses to the waiting requests until the stream fails.
+func (ps *pipelinedStream) readLoop(r msgio.ReadCloser) {
+	for {
+		bytes, err := r.ReadMsg()
+		if err != nil {
+			r.ReleaseMsg(bytes)
+			ps.fail(err)
+			return
+		}
+		mes := new(pb.Message)
+		err = mes.Unmarshal(bytes)
+		r.ReleaseMsg(bytes)
+		if err != nil {
+			ps.fail(err)
+			return
+		}
+
+		ps.mu.Lock()
+		ch, ok := ps.pending[mes.GetRequestId()]
+		delete(ps.pending, mes.GetRequestId())
+		ps.mu.Unlock()
+
+		// Responses to requests we have given up on are dropped.
+		if ok {
+			ch <- mes
+		}
+	}
+}
+
+// fail closes the stream and fails all outstanding requests with err.
+func (ps *pipelinedStream) fail(err error) {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return
+	}
+	ps.closed = true
+	ps.err = err
+	pending := ps.pending
+	ps.pending = nil
+	ps.mu.Unlock()
+
+	for _, ch := range pending {
+		close(ch)
+	}
+	_ = ps.s.Reset()
+}
+
+func (ps *pipelinedStream) isClosed() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.closed
+}
+
+func (ps *pipelinedStream) closeErr() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.err
+}
+
+func (ps *pipelinedStream) writeMsg(pmes *pb.Message) error {
+	ps.wlk.Lock()
+	err := writeMsg(ps.s, pmes)
+	ps.wlk.Unlock()
+	if err != nil {
+		ps.fail(err)
+	}
+	return err
+}
+
+// sendMessage sends a message we don't expect a response to.
+func (ps *pipelinedStream) sendMessage(pmes *pb.Message) error {
+	if ps.isClosed() {
+		return ps.closeErr()
+	}
+	return ps.writeMsg(pmes)
+}
+
+func (ps *pipelinedStream) sendRequest(ctx context.Context, pmes *pb.Message, timeout time.Duration) (*pb.Message, error) {
+	ch := make(chan *pb.Message, 1)
+
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		return nil, ps.err
+	}
+	ps.nextID++
+	id := ps.nextID
+	ps.pending[id] = ch
+	ps.mu.Unlock()
+
+	// Don't modify the caller's message, it may be shared between requests to different peers.
+	req := *pmes
+	req.RequestId = id
+	if err := ps.writeMsg(&req); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case mes, ok := <-ch:
+		if !ok {
+			return nil, ps.closeErr()
+		}
+		return mes, nil
+	case <-ctx.Done():
+		ps.forget(id)
+		return nil, ctx.Err()
+	case <-t.C:
+		ps.forget(id)
+		return nil, ErrReadTimeout
+	}
+}
+
+func (ps *pipelinedStream) forget(id uint64) {
+	ps.mu.Lock()
+	delete(ps.pending, id)
+	ps.mu.Unlock()
+}
@@ -16,7 +16,9 @@ import (
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p-kad-dht/rtrefresh"
 
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
@@ -61,8 +63,33 @@ type config struct {
 	providersOptions   []providers.Option
 	queryPeerFilter    QueryFilterFunc
 	// #BDWare
-	protectAllBuckets bool
-	protectedBuckets  int
+	protectAllBuckets       bool
+	protectedBuckets        int
+	enableRequestPipelining bool
+	disjointPaths           int
+	hedgePercentile         float64
+
+	optimisticProvide struct {
+		enabled     bool
+		returnRatio float64
+	}
+
+	enableLookupSharing bool
+	negativeCacheTTL    time.Duration
+	readRepair          readRepairConfig
+	staleValueThreshold int
+	closestPeersCache   struct {
+		ttl        time.Duration
+		regionBits int
+	}
+
+	publicKeyRepublishInterval time.Duration
+	publicKeys                 struct {
+		negativeTTL time.Duration
+		concurrency int
+	}
+	largeValueChunkSize int
+	privateProviders    bool
 
 	routingTable struct {
 		refreshQueryTimeout time.Duration
@@ -76,6 +103,24 @@ type config struct {
 		considerLatency        bool
 		avgBitsImprovedPerStep float64
 		avgRoundTripPerStep    float64
+		peerPingTimeout        time.Duration
+		freezeTimeout          time.Duration
+	}
+
+	// #BDWare
+	timeouts struct {
+		readMessage        time.Duration
+		readMessageForType map[pb.Message_MessageType]time.Duration
+		adaptiveRead       adaptiveTimeout
+		streamIdle         time.Duration
+		readRepair         time.Duration
+	}
+
+	// #BDWare
+	messageSenders struct {
+		maxSenders       int
+		idleTimeout      time.Duration
+		streamReuseTries int
 	}
 
 	bootstrapPeers []peer.AddrInfo
@@ -110,6 +155,19 @@ func (c *config) applyFallbacks(h host.Host) error {
 			if _, ipnsFound := nsval["ipns"]; !ipnsFound {
 				nsval["ipns"] = ipns.Validator{KeyBook: h.Peerstore()}
 			}
+			// #BDWare
+			// the public IPFS DHT only accepts the pk and ipns namespaces
+			if _, chunkFound := nsval["chunk"]; !chunkFound && c.protocolPrefix != DefaultPrefix {
+				nsval["chunk"] = ChunkValidator{}
+			}
+			// #BDWare
+			if _, manifestFound := nsval["manifest"]; !manifestFound && c.protocolPrefix != DefaultPrefix {
+				nsval["manifest"] = ManifestValidator{}
+			}
+			// #BDWare
+			if _, privprovFound := nsval["privprov"]; !privprovFound && c.privateProviders {
+				nsval["privprov"] = PrivateProvidersValidator{}
+			}
 		} else {
 			return fmt.Errorf("the default validator was changed without being marked as changed")
 		}
@@ -157,6 +215,22 @@ var defaults = func(o *config) error {
 	// #BDWare
 	o.protectAllBuckets = false
 	o.protectedBuckets = defaultProtectedBuckets
+	o.disjointPaths = 1
+	o.optimisticProvide.returnRatio = 0.75
+	o.enableLookupSharing = false
+	o.readRepair.enabled = true
+	o.staleValueThreshold = defaultStaleValueThreshold
+	o.publicKeys.negativeTTL = defaultPublicKeyNegativeTTL
+	o.publicKeys.concurrency = defaultPublicKeyFetchConcurrency
+	o.largeValueChunkSize = defaultLargeValueChunkSize
+	o.messageSenders.streamReuseTries = defaultStreamReuseTries
+
+	o.timeouts.readMessage = dhtReadMessageTimeout
+	o.timeouts.readMessageForType = make(map[pb.Message_MessageType]time.Duration)
+	o.timeouts.streamIdle = dhtStreamIdleTimeout
+	o.timeouts.readRepair = defaultReadRepairTimeout
+	o.routingTable.peerPingTimeout = rtrefresh.DefaultPeerPingTimeout
+	o.routingTable.freezeTimeout = rtFreezeTimeout
 
 	return nil
 }
@@ -252,9 +326,12 @@ func Mode(m ModeOpt) Option {
 // Validator configures the DHT to use the specified validator.
 //
 // Defaults to a namespaced validator that can validate both public key (under the "pk"
-// namespace) and IPNS records (under the "ipns" namespace). Setting the validator
-// implies that the user wants to control the validators and therefore the default
-// public key and IPNS validators will not be added.
+// namespace) and IPNS records (under the "ipns" namespace), as well as the chunks and
+// manifests of large values (under the "chunk" and "manifest" namespaces, see
+// PutLargeValue) unless the protocol prefix is the default one, and private provider
+// records (under the "privprov" namespace, see ProvidePrivate) with EnablePrivateProviders.
+// Setting the validator implies that the user wants to control the validators and therefore
+// the default public key, IPNS, chunk, manifest and private provider validators will not be added.
 func Validator(v record.Validator) Option {
 	return func(c *config) error {
 		c.validator = v
@@ -528,3 +605,457 @@ func AvgRoundTripPerStep(avgRoundTripPerStep float64) Option {
 		return nil
 	}
 }
+
+// #BDWare
+// EnableRequestPipelining allows multiple concurrent requests to the same peer to share a single stream. Requests
+// carry a request ID and responses are matched to them by that ID, so a slow response no longer holds up every other
+// request to that peer.
+//
+// Pipelining is negotiated per peer: we serve the pipelined protocol alongside the primary one and prefer it when
+// opening streams, falling back to one request at a time per stream for peers that don't support it.
+//
+// Defaults to disabled.
+func EnableRequestPipelining() Option {
+	return func(c *config) error {
+		c.enableRequestPipelining = true
+		return nil
+	}
+}
+
+// #BDWare
+// MaxMessageSenders limits the number of peers we keep a message sender (and therefore a stream) open to. When the
+// limit is reached, the least recently used message sender is closed. Set to 0 for no limit.
+//
+// Defaults to 0.
+func MaxMessageSenders(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("max message senders must be non-negative, got %d", n)
+		}
+		c.messageSenders.maxSenders = n
+		return nil
+	}
+}
+
+// #BDWare
+// MessageSenderIdleTimeout closes the message sender (and therefore the stream) to a peer we haven't sent anything to
+// for the given duration. Set to 0 to keep message senders open until the peer disconnects.
+//
+// Defaults to 0.
+func MessageSenderIdleTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout < 0 {
+			return fmt.Errorf("message sender idle timeout must be non-negative, got %s", timeout)
+		}
+		c.messageSenders.idleTimeout = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// StreamReuseTries configures how many times we retry on a fresh stream after a reused stream to a peer failed,
+// before giving up on reusing streams to that peer and opening a new stream for every message.
+// MessageSenderStats can help tuning it.
+//
+// Defaults to 3.
+func StreamReuseTries(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("stream reuse tries must be non-negative, got %d", n)
+		}
+		c.messageSenders.streamReuseTries = n
+		return nil
+	}
+}
+
+// #BDWare
+// ReadMessageTimeout configures how long we wait for a peer to respond to a request before giving up on it.
+// It can be overridden for specific message types with ReadMessageTimeoutForType, and per peer with
+// AdaptiveReadMessageTimeout.
+//
+// Defaults to 10 seconds.
+func ReadMessageTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("read message timeout must be positive, got %s", timeout)
+		}
+		c.timeouts.readMessage = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// ReadMessageTimeoutForType overrides the ReadMessageTimeout and the AdaptiveReadMessageTimeout for requests of the
+// given message type, e.g. to give peers more time to answer GET_PROVIDERS requests than PING requests.
+func ReadMessageTimeoutForType(t pb.Message_MessageType, timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("read message timeout for %s must be positive, got %s", t, timeout)
+		}
+		c.timeouts.readMessageForType[t] = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// AdaptiveReadMessageTimeout derives the read timeout for a peer from the latency we observed to that peer, instead
+// of using the same fixed timeout for all peers. The timeout is the peer's average latency times the multiplier,
+// bounded by min and max. The ReadMessageTimeout is still used for peers we haven't measured any latency to yet, and
+// the timeouts set with ReadMessageTimeoutForType take precedence over the adaptive timeout.
+//
+// This helps on high-latency links (e.g. satellite) where a fixed timeout is either too short for some peers or
+// much too long for the others.
+//
+// Defaults to disabled.
+func AdaptiveReadMessageTimeout(multiplier float64, min, max time.Duration) Option {
+	return func(c *config) error {
+		if multiplier <= 0 {
+			return fmt.Errorf("adaptive read timeout multiplier must be positive, got %f", multiplier)
+		}
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid adaptive read timeout bounds [%s, %s]", min, max)
+		}
+		c.timeouts.adaptiveRead = adaptiveTimeout{
+			enabled:    true,
+			multiplier: multiplier,
+			min:        min,
+			max:        max,
+		}
+		return nil
+	}
+}
+
+// #BDWare
+// StreamIdleTimeout configures how long we keep an inbound stream open without receiving any request on it.
+//
+// Defaults to 1 minute.
+func StreamIdleTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("stream idle timeout must be positive, got %s", timeout)
+		}
+		c.timeouts.streamIdle = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// ReadRepairTimeout configures the timeout for storing the best value found by GetValue/SearchValue at the peers
+// that returned an outdated value or no value at all (see DisableReadRepair).
+//
+// Defaults to 30 seconds.
+func ReadRepairTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("read repair timeout must be positive, got %s", timeout)
+		}
+		c.timeouts.readRepair = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// RoutingTablePeerPingTimeout configures how long a routing table refresh waits for a peer it hasn't heard from in a
+// while to respond to a liveliness check before evicting it.
+//
+// Defaults to 10 seconds.
+func RoutingTablePeerPingTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("routing table peer ping timeout must be positive, got %s", timeout)
+		}
+		c.routingTable.peerPingTimeout = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// RoutingTableFreezeTimeout configures how long after the initial bootstrap refreshes the peers in the routing table
+// are marked as irreplaceable.
+//
+// Defaults to 1 minute.
+func RoutingTableFreezeTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("routing table freeze timeout must be positive, got %s", timeout)
+		}
+		c.routingTable.freezeTimeout = timeout
+		return nil
+	}
+}
+
+// #BDWare
+// DisjointPaths splits every lookup into d paths that don't share any peers, as described in the S/Kademlia paper.
+// The closest peers we know are dealt out to the paths and every peer learned during the lookup is only queried by
+// the path that heard about it first, so an adversary has to control a peer on every path to eclipse the lookup.
+// It can be overridden for a single call with LookupDisjointPaths.
+//
+// Defaults to 1.
+func DisjointPaths(d int) Option {
+	return func(c *config) error {
+		if d < 1 {
+			return fmt.Errorf("disjoint paths must be at least 1, got %d", d)
+		}
+		c.disjointPaths = d
+		return nil
+	}
+}
+
+// #BDWare
+// EnableOptimisticProvide makes Provide store the provider record on the peers of the lookup that are likely among
+// the K closest peers to the key as soon as they respond, based on the estimated network size, and return once enough
+// of them stored it (see OptimisticProvideReturnRatio). The lookup and the remaining stores go on in the background.
+//
+// Defaults to disabled.
+func EnableOptimisticProvide() Option {
+	return func(c *config) error {
+		c.optimisticProvide.enabled = true
+		return nil
+	}
+}
+
+// #BDWare
+// OptimisticProvideReturnRatio configures which fraction of the K closest peers must have stored a provider record
+// before an optimistic Provide returns. Higher ratios make it more likely that the record reached the actual closest
+// peers by the time Provide returns, lower ratios make Provide return faster.
+// It has no effect unless EnableOptimisticProvide is set.
+//
+// Defaults to 0.75.
+func OptimisticProvideReturnRatio(ratio float64) Option {
+	return func(c *config) error {
+		if ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("optimistic provide return ratio must be in (0, 1], got %v", ratio)
+		}
+		c.optimisticProvide.returnRatio = ratio
+		return nil
+	}
+}
+
+// #BDWare
+// QueryHedging makes lookups consider a query slow once it takes longer than the given percentile of the recent
+// queries to the same peer (or to all peers, for peers we haven't queried often enough), e.g. 0.9. A lookup then
+// queries the next peer it heard of without cancelling the slow query, and terminates without waiting for it: the
+// reply of the slow query is only used if it arrives first. At most as many queries as the concurrency are hedged at
+// the same time.
+//
+// Defaults to disabled.
+func QueryHedging(percentile float64) Option {
+	return func(c *config) error {
+		if percentile <= 0 || percentile >= 1 {
+			return fmt.Errorf("query hedging percentile must be in (0, 1), got %v", percentile)
+		}
+		c.hedgePercentile = percentile
+		return nil
+	}
+}
+
+// #BDWare
+// EnableLookupSharing makes concurrent GetValue, SearchValue, GetValues and FindProvidersAsync calls for the same key
+// attach to the lookup already running for it, and receive all of its results, including those found before they
+// attached. A shared lookup runs in the context of the DHT rather than in the context of one of the callers, and is
+// cancelled once all of its callers left.
+//
+// Defaults to disabled: every call runs its own lookup.
+func EnableLookupSharing() Option {
+	return func(c *config) error {
+		c.enableLookupSharing = true
+		return nil
+	}
+}
+
+// #BDWare
+// ClosestPeersCache makes the DHT remember, for the given time, the peers that responded to the last completed lookup
+// in every key region, i.e. for every prefix of regionBits bits of the Kademlia IDs of the keys. Lookups for keys of
+// the same region then start from these peers as well as from the routing table, which gets them to the closest
+// peers in fewer hops when looking up many nearby keys in a row.
+//
+// Defaults to disabled.
+func ClosestPeersCache(ttl time.Duration, regionBits int) Option {
+	return func(c *config) error {
+		if ttl <= 0 {
+			return fmt.Errorf("closest peers cache ttl must be positive, got %s", ttl)
+		}
+		if regionBits < 1 || regionBits > 256 {
+			return fmt.Errorf("closest peers cache region bits must be in [1, 256], got %d", regionBits)
+		}
+		c.closestPeersCache.ttl = ttl
+		c.closestPeersCache.regionBits = regionBits
+		return nil
+	}
+}
+
+// #BDWare
+// NegativeCache makes GetValue, SearchValue, FindProvidersAsync and FindPeer remember for the given time the keys
+// their completed lookups found nothing for, and return routing.ErrNotFound (or no results) for them without running
+// a lookup until then. Values and providers stored locally are still returned, and storing a value or providing a key
+// locally forgets that nothing was found for it. A call can bypass the cache with BypassNegativeCache.
+//
+// Defaults to disabled.
+func NegativeCache(ttl time.Duration) Option {
+	return func(c *config) error {
+		if ttl <= 0 {
+			return fmt.Errorf("negative cache ttl must be positive, got %s", ttl)
+		}
+		c.negativeCacheTTL = ttl
+		return nil
+	}
+}
+
+// #BDWare
+// DisableReadRepair stops GetValue and SearchValue from storing the value they found at the closest peers of the
+// lookup that returned an outdated value or no value at all.
+func DisableReadRepair() Option {
+	return func(c *config) error {
+		c.readRepair.enabled = false
+		return nil
+	}
+}
+
+// #BDWare
+// ReadRepairClosestPeers limits read-repair to the k closest peers to the key the lookup found.
+//
+// Defaults to all the peers of the lookup result, i.e. the K closest peers.
+func ReadRepairClosestPeers(k int) Option {
+	return func(c *config) error {
+		if k < 1 {
+			return fmt.Errorf("read repair closest peers must be at least 1, got %d", k)
+		}
+		c.readRepair.closestPeers = k
+		return nil
+	}
+}
+
+// #BDWare
+// SyncReadRepair makes GetValue and SearchValue wait for read-repair to complete before returning, instead of
+// repairing the peers in the background. GetValueDetailed always waits for read-repair, to report its outcomes.
+func SyncReadRepair() Option {
+	return func(c *config) error {
+		c.readRepair.sync = true
+		return nil
+	}
+}
+
+// #BDWare
+// ReadRepairRateLimit limits read-repair to perSecond peers per second on average, with bursts of up to burst peers.
+// The repairs over the limit are skipped.
+//
+// Defaults to unlimited.
+func ReadRepairRateLimit(perSecond float64, burst int) Option {
+	return func(c *config) error {
+		if perSecond <= 0 {
+			return fmt.Errorf("read repair rate must be positive, got %v", perSecond)
+		}
+		if burst < 1 {
+			return fmt.Errorf("read repair burst must be at least 1, got %d", burst)
+		}
+		c.readRepair.rate = perSecond
+		c.readRepair.burst = burst
+		return nil
+	}
+}
+
+// #BDWare
+// ReadRepairConcurrency bounds the number of peers being repaired at the same time. The repairs over the bound wait
+// for a slot, within the read-repair timeout.
+//
+// Defaults to unbounded.
+func ReadRepairConcurrency(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("read repair concurrency must be at least 1, got %d", n)
+		}
+		c.readRepair.concurrency = n
+		return nil
+	}
+}
+
+// #BDWare
+// PublishPublicKey publishes the node's public key record (/pk/<peer ID>) to the network once the routing table has
+// peers, and republishes it every republishInterval so that it doesn't expire (see MaxRecordAge). This is useful for
+// keys that can't be extracted from the peer ID, e.g. RSA keys. Failed publications are retried with a backoff of
+// up to 5 minutes rather than at the next republish.
+//
+// The node always stores and serves its own public key record, whether or not it is published.
+func PublishPublicKey(republishInterval time.Duration) Option {
+	return func(c *config) error {
+		if republishInterval <= 0 {
+			return fmt.Errorf("public key republish interval must be positive, got %v", republishInterval)
+		}
+		c.publicKeyRepublishInterval = republishInterval
+		return nil
+	}
+}
+
+// #BDWare
+// PublicKeyNegativeCacheTTL configures how long GetPublicKey remembers that it failed to fetch the public key of a
+// peer, returning the same error without fetching it again until then. A ttl of 0 disables the negative cache.
+//
+// Defaults to 1 minute.
+func PublicKeyNegativeCacheTTL(ttl time.Duration) Option {
+	return func(c *config) error {
+		if ttl < 0 {
+			return fmt.Errorf("public key negative cache ttl must not be negative, got %s", ttl)
+		}
+		c.publicKeys.negativeTTL = ttl
+		return nil
+	}
+}
+
+// #BDWare
+// PublicKeyFetchConcurrency bounds the number of public keys GetPublicKey and GetPublicKeys fetch from the network at
+// the same time, across all calls.
+//
+// Defaults to 32.
+func PublicKeyFetchConcurrency(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("public key fetch concurrency must be at least 1, got %d", n)
+		}
+		c.publicKeys.concurrency = n
+		return nil
+	}
+}
+
+// #BDWare
+// LargeValueChunkSize configures the size of the chunks PutLargeValue splits values into. It must leave room in a
+// message for the record around the chunk, i.e. be at most half of network.MessageSizeMax.
+//
+// Defaults to 1 MiB.
+func LargeValueChunkSize(size int) Option {
+	return func(c *config) error {
+		if size < 1 || size > maxLargeValueChunkSize {
+			return fmt.Errorf("large value chunk size must be between 1 and %d, got %d", maxLargeValueChunkSize, size)
+		}
+		c.largeValueChunkSize = size
+		return nil
+	}
+}
+
+// #BDWare
+// StaleValueThreshold evicts a peer from the routing table once it returned n outdated values in a row to searches
+// for values (see StaleValueCount), so that lookups stop asking it. Returning the value a search resolved resets the
+// count. 0 disables the eviction.
+//
+// Defaults to 3.
+func StaleValueThreshold(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("stale value threshold must not be negative, got %d", n)
+		}
+		c.staleValueThreshold = n
+		return nil
+	}
+}
+
+// #BDWare
+// EnablePrivateProviders makes the DHT store and serve private provider records (see ProvidePrivate), by validating
+// the "privprov" namespace of the values with PrivateProvidersValidator. The DHTs that don't enable them refuse the
+// records, so all the peers of the network should enable them.
+//
+// Defaults to disabled: ProvidePrivate and FindProvidersPrivate return routing.ErrNotSupported.
+func EnablePrivateProviders() Option {
+	return func(c *config) error {
+		c.privateProviders = true
+		return nil
+	}
+}
@@ -21,13 +21,17 @@ import (
 
 	"github.com/libp2p/go-libp2p"
 	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/routing"
 
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	test "github.com/libp2p/go-libp2p-kad-dht/testing"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	record "github.com/libp2p/go-libp2p-record"
@@ -163,6 +167,41 @@ func setupDHTS(t *testing.T, ctx context.Context, n int, options ...Option) []*I
 	return dhts
 }
 
+// setupConnectedDHTS sets up n DHTs connected to each other, that are closed at the end of the test.
+func setupConnectedDHTS(t *testing.T, ctx context.Context, n int, options ...Option) []*IpfsDHT {
+	dhts := setupDHTS(t, ctx, n, options...)
+	t.Cleanup(func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	})
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			connect(t, ctx, dhts[i], dhts[j])
+		}
+	}
+	return dhts
+}
+
+// setupRingDHTS sets up n DHTs in a ring, every DHT connected to the k next ones, that are closed at the end of the
+// test.
+func setupRingDHTS(t *testing.T, ctx context.Context, n, k int, options ...Option) []*IpfsDHT {
+	dhts := setupDHTS(t, ctx, n, options...)
+	t.Cleanup(func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	})
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k; j++ {
+			connect(t, ctx, dhts[i], dhts[(i+j)%n])
+		}
+	}
+	return dhts
+}
+
 func connectNoSync(t *testing.T, ctx context.Context, a, b *IpfsDHT) {
 	t.Helper()
 
@@ -570,6 +609,621 @@ func TestValueGetInvalid(t *testing.T) {
 	testSetGet("valid", "newer", nil)
 }
 
+func TestGetValueDetailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupConnectedDHTS(t, ctx, nDHTs)
+	querier := dhts[0]
+	querier.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+
+	key := "/v/hello"
+	for i, val := range []string{"newer", "valid", "expired"} {
+		rec := record.MakePutRecord(key, []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, dhts[i+1].putLocal(key, rec))
+	}
+
+	res, err := querier.GetValueDetailed(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("newer"), res.Value)
+	require.True(t, res.Completed)
+	require.Empty(t, res.NotFound)
+	require.Len(t, res.Responses, 3)
+	require.Equal(t, []peer.ID{dhts[1].self}, res.SelectedFrom())
+	for _, resp := range res.Responses {
+		require.Equal(t, resp.From != dhts[3].self, resp.Valid)
+	}
+	// the peer that returned an invalid value failed the query, only the one with an outdated value is repaired
+	require.Equal(t, []PeerRepair{{Peer: dhts[2].self, Outcome: RepairSucceeded}}, res.Repairs)
+	rec, err := dhts[2].getLocal(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("newer"), rec.GetValue())
+
+	res, err = querier.GetValueDetailed(ctx, "/v/missing")
+	require.Equal(t, routing.ErrNotFound, err)
+	require.Nil(t, res.Value)
+	require.Len(t, res.NotFound, 3)
+}
+
+func TestReadRepair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	var dhts []*IpfsDHT
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	// newQuerier connects a querier with the given options to its own peers, so that lookups only find those
+	newQuerier := func(opts ...Option) *IpfsDHT {
+		t.Helper()
+		querier := setupDHT(ctx, t, false, opts...)
+		querier.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+		peers := setupDHTS(t, ctx, nDHTs)
+		for i, d := range peers {
+			connect(t, ctx, querier, d)
+			// peers that respond without a value nor closer peers fail the query
+			for _, other := range peers[i+1:] {
+				connect(t, ctx, d, other)
+			}
+		}
+		dhts = append(append(dhts, querier), peers...)
+		return querier
+	}
+	// putValues stores the newest value at the peer furthest from the key and the given value at the others, and
+	// returns the peers sorted by distance to the key
+	putValues := func(querier *IpfsDHT, key string, val string) []*IpfsDHT {
+		t.Helper()
+		byPeer := make(map[peer.ID]*IpfsDHT)
+		peers := make([]peer.ID, 0, nDHTs)
+		for _, d := range dhts[len(dhts)-nDHTs:] {
+			byPeer[d.self] = d
+			peers = append(peers, d.self)
+		}
+		peers = querier.routingTable.SortClosestPeers(peers, kb.ConvertKey(key))
+		sorted := make([]*IpfsDHT, 0, nDHTs)
+		for i, p := range peers {
+			sorted = append(sorted, byPeer[p])
+			v := val
+			if i == len(peers)-1 {
+				v = "newer"
+			}
+			if v == "" {
+				continue
+			}
+			rec := record.MakePutRecord(key, []byte(v))
+			rec.TimeReceived = u.FormatRFC3339(time.Now())
+			require.NoError(t, byPeer[p].putLocal(key, rec))
+		}
+		return sorted
+	}
+	requireValue := func(d *IpfsDHT, key string, val string) {
+		t.Helper()
+		rec, err := d.getLocal(key)
+		require.NoError(t, err)
+		if val == "" {
+			require.Nil(t, rec)
+		} else {
+			require.Equal(t, []byte(val), rec.GetValue())
+		}
+	}
+
+	// disabled read-repair leaves the outdated values, that count against the peers returning them
+	querier := newQuerier(DisableReadRepair())
+	key := "/v/disabled"
+	peers := putValues(querier, key, "valid")
+	res, err := querier.GetValueDetailed(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("newer"), res.Value)
+	require.Empty(t, res.Repairs)
+	for _, d := range peers[:2] {
+		requireValue(d, key, "valid")
+		require.Equal(t, 1, querier.StaleValueCount(d.self))
+	}
+	require.Equal(t, 0, querier.StaleValueCount(peers[2].self))
+
+	// peers returning outdated values in a row are evicted from the routing table, which forgets their count
+	_, err = querier.GetValue(ctx, key)
+	require.NoError(t, err)
+	for _, d := range peers[:2] {
+		require.Equal(t, 2, querier.StaleValueCount(d.self))
+	}
+	_, err = querier.GetValue(ctx, key)
+	require.NoError(t, err)
+	for _, d := range peers[:2] {
+		require.Equal(t, 0, querier.StaleValueCount(d.self))
+	}
+
+	// only the closest peers are repaired
+	querier = newQuerier(ReadRepairClosestPeers(1))
+	key = "/v/closest"
+	peers = putValues(querier, key, "")
+	res, err = querier.GetValueDetailed(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []PeerRepair{{Peer: peers[0].self, Outcome: RepairSucceeded}}, res.Repairs)
+	requireValue(peers[0], key, "newer")
+	requireValue(peers[1], key, "")
+	// peers without a value aren't stale
+	require.Equal(t, 0, querier.StaleValueCount(peers[1].self))
+
+	// the repairs over the rate limit are skipped
+	querier = newQuerier(ReadRepairRateLimit(0.001, 1))
+	key = "/v/limited"
+	putValues(querier, key, "")
+	res, err = querier.GetValueDetailed(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, res.Repairs, 2)
+	outcomes := []RepairOutcome{res.Repairs[0].Outcome, res.Repairs[1].Outcome}
+	require.ElementsMatch(t, []RepairOutcome{RepairSucceeded, RepairSkipped}, outcomes)
+
+	// synchronous read-repair completes before SearchValue returns
+	querier = newQuerier(SyncReadRepair())
+	key = "/v/sync"
+	peers = putValues(querier, key, "valid")
+	valCh, err := querier.SearchValue(ctx, key)
+	require.NoError(t, err)
+	for range valCh {
+	}
+	for _, d := range peers {
+		requireValue(d, key, "newer")
+	}
+
+	// a peer refusing the value because it has a better one rejects it as old
+	key = "/v/old"
+	peers = putValues(querier, key, "")
+	peers[2].Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	outcome, err := querier.repairPeer(ctx, peers[2].self, record.MakePutRecord(key, []byte("valid")))
+	require.Error(t, err)
+	require.Equal(t, RepairRejectedOld, outcome)
+}
+
+func TestValueResolution(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 5
+	dhts := setupConnectedDHTS(t, ctx, nDHTs)
+	querier := dhts[0]
+	querier.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+
+	// the newest value is only stored at the peer furthest from the key
+	key := "/v/hello"
+	peers := make([]peer.ID, 0, nDHTs-1)
+	byPeer := make(map[peer.ID]*IpfsDHT)
+	for _, d := range dhts[1:] {
+		peers = append(peers, d.self)
+		byPeer[d.self] = d
+	}
+	peers = querier.routingTable.SortClosestPeers(peers, kb.ConvertKey(key))
+	for i, val := range []string{"valid", "valid", "", "newer"} {
+		if val == "" {
+			continue
+		}
+		rec := record.MakePutRecord(key, []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, byPeer[peers[i]].putLocal(key, rec))
+	}
+
+	getValue := func(opts ...routing.Option) (string, error) {
+		t.Helper()
+		res, err := querier.GetValueDetailed(ctx, key, opts...)
+		return string(res.Value), err
+	}
+
+	val, err := getValue(FirstValidValue())
+	require.NoError(t, err)
+	require.Contains(t, []string{"valid", "newer"}, val)
+
+	val, err = getValue(QuorumAgreement(2))
+	require.NoError(t, err)
+	require.Equal(t, "valid", val)
+	_, err = getValue(QuorumAgreement(3))
+	require.Equal(t, routing.ErrNotFound, err)
+
+	val, err = getValue(FreshestValue(3))
+	require.NoError(t, err)
+	require.Equal(t, "newer", val)
+	_, err = getValue(FreshestValue(4))
+	require.Equal(t, routing.ErrNotFound, err)
+
+	val, err = getValue(ClosestPeersValue(), LookupResultSize(2))
+	require.NoError(t, err)
+	require.Equal(t, "valid", val)
+
+	// SearchValue streams the value resolved by the strategy
+	valCh, err := querier.SearchValue(ctx, key, QuorumAgreement(2))
+	require.NoError(t, err)
+	var vals []string
+	for v := range valCh {
+		vals = append(vals, string(v))
+	}
+	require.Equal(t, []string{"valid"}, vals)
+
+	// by default, the best value of all peers is returned
+	val, err = getValue()
+	require.NoError(t, err)
+	require.Equal(t, "newer", val)
+}
+
+func TestWatchValue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	dhts := setupConnectedDHTS(t, ctx, nDHTs)
+	watcher := dhts[0]
+	watcher.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+
+	key := "/v/hello"
+	putValue := func(val string) {
+		t.Helper()
+		rec := record.MakePutRecord(key, []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		for _, d := range dhts[1:] {
+			require.NoError(t, d.putLocal(key, rec))
+		}
+	}
+	requireNext := func(ch <-chan []byte, val string) {
+		t.Helper()
+		select {
+		case v, ok := <-ch:
+			require.True(t, ok)
+			require.Equal(t, val, string(v))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", val)
+		}
+	}
+
+	_, err := watcher.WatchValue(ctx, key, 0)
+	require.Error(t, err)
+
+	putValue("valid")
+	ctx1, cancel1 := context.WithCancel(ctx)
+	defer cancel1()
+	ch1, err := watcher.WatchValue(ctx1, key, 10*time.Millisecond)
+	require.NoError(t, err)
+	requireNext(ch1, "valid")
+
+	// a second subscriber shares the watcher and receives the current value
+	ctx2, cancel2 := context.WithCancel(ctx)
+	defer cancel2()
+	ch2, err := watcher.WatchValue(ctx2, key, time.Hour)
+	require.NoError(t, err)
+	requireNext(ch2, "valid")
+	watcher.valueWatchers.mu.Lock()
+	require.Len(t, watcher.valueWatchers.watchers, 1)
+	watcher.valueWatchers.mu.Unlock()
+
+	putValue("newer")
+	requireNext(ch1, "newer")
+	requireNext(ch2, "newer")
+
+	// older values aren't sent
+	putValue("valid")
+	select {
+	case v := <-ch1:
+		t.Fatalf("unexpected value %q", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel1()
+	require.Eventually(t, func() bool {
+		_, ok := <-ch1
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel2()
+	require.Eventually(t, func() bool {
+		watcher.valueWatchers.mu.Lock()
+		defer watcher.valueWatchers.mu.Unlock()
+		return len(watcher.valueWatchers.watchers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok := <-ch2
+	require.False(t, ok)
+}
+
+func TestLargeValue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	dhts := setupConnectedDHTS(t, ctx, nDHTs)
+
+	// the value doesn't fit in a single message
+	value := make([]byte, network.MessageSizeMax+defaultLargeValueChunkSize/2)
+	rand.Read(value)
+	key, err := dhts[0].PutLargeValue(ctx, value)
+	require.NoError(t, err)
+
+	data, err := dhts[2].GetValue(ctx, key)
+	require.NoError(t, err)
+	m, err := UnmarshalManifest(data)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(value)), m.Size)
+	require.Len(t, m.Chunks, 5)
+	require.Equal(t, key, ManifestKey(m))
+
+	got, err := dhts[2].GetLargeValue(ctx, key, uint64(len(value)))
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	// values larger than the caller's limit aren't fetched
+	_, err = dhts[2].GetLargeValue(ctx, key, uint64(len(value)-1))
+	require.Error(t, err)
+
+	// chunks and manifests are committed to by their key
+	require.NoError(t, ChunkValidator{}.Validate(ChunkKey(m.Chunks[0]), value[:defaultLargeValueChunkSize]))
+	require.Error(t, ChunkValidator{}.Validate(ChunkKey(m.Chunks[0]), value[1:defaultLargeValueChunkSize+1]))
+	_, err = UnmarshalManifest(value[:100])
+	require.Error(t, err)
+	forged := *m
+	forged.Size--
+	require.Error(t, ManifestValidator{}.Validate(key, forged.Marshal()))
+	require.Error(t, dhts[1].PutValue(ctx, key, forged.Marshal()))
+
+	// a manifest pointing to a missing chunk can't be fetched
+	missing, err := multihash.Sum([]byte("missing"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	m.Chunks[4] = missing
+	require.NoError(t, dhts[0].PutValue(ctx, ManifestKey(m), m.Marshal()))
+	_, err = dhts[2].GetLargeValue(ctx, ManifestKey(m), m.Size)
+	require.Error(t, err)
+}
+
+func TestSignedValue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 3
+	dhts := setupConnectedDHTS(t, ctx, nDHTs, NamespacedValidator("signed", SignedValidator{}))
+
+	key := SignedValueKey("signed", dhts[0].self, "profile")
+	require.NoError(t, dhts[0].PutSignedValue(ctx, key, []byte("v1"), time.Hour))
+	val, err := dhts[2].GetSignedValue(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+
+	// a new value supersedes the previous one
+	require.NoError(t, dhts[0].PutSignedValue(ctx, key, []byte("v2"), time.Hour))
+	data, err := dhts[2].GetValue(ctx, key)
+	require.NoError(t, err)
+	rec, err := UnmarshalSignedRecord(data)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rec.Seq)
+	require.Equal(t, []byte("v2"), rec.Value)
+
+	// only the peer of the key can sign values for it
+	require.Error(t, dhts[1].PutSignedValue(ctx, key, []byte("v3"), time.Hour))
+
+	v := SignedValidator{}
+	require.NoError(t, v.Validate(key, data))
+	// the signature covers the key and the value
+	require.Error(t, v.Validate(SignedValueKey("signed", dhts[0].self, "other"), data))
+	require.Error(t, v.Validate(SignedValueKey("signed", dhts[1].self, "profile"), data))
+	tampered := *rec
+	tampered.Value = []byte("v3")
+	require.Error(t, v.Validate(key, tampered.Marshal()))
+	// expired values are invalid, even if correctly signed
+	sk := dhts[0].peerstore.PrivKey(dhts[0].self)
+	expired := *rec
+	expired.Expiry = time.Now().Add(-time.Second)
+	expired.Signature, err = sk.Sign(expired.signedBytes(key))
+	require.NoError(t, err)
+	require.Error(t, v.Validate(key, expired.Marshal()))
+
+	older := *rec
+	older.Seq = 0
+	i, err := v.Select(key, [][]byte{older.Marshal(), data})
+	require.NoError(t, err)
+	require.Equal(t, 1, i)
+}
+
+func TestSetValue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupConnectedDHTS(t, ctx, nDHTs, NamespacedValidator("group", SetValidator{MaxEntries: 3}))
+	entryValues := func(entries []SetEntry) []string {
+		var vals []string
+		for _, e := range entries {
+			vals = append(vals, string(e.Value))
+		}
+		return vals
+	}
+
+	// concurrent writers don't lose each other's updates
+	key := "/group/members"
+	var wg sync.WaitGroup
+	for i, member := range []string{"alice", "bob"} {
+		wg.Add(1)
+		go func(d *IpfsDHT, member string) {
+			defer wg.Done()
+			assert.NoError(t, d.AddSetEntry(ctx, key, []byte(member)))
+		}(dhts[i+1], member)
+	}
+	wg.Wait()
+	entries, err := dhts[3].GetSetEntries(ctx, key)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"alice", "bob"}, entryValues(entries))
+	for _, e := range entries {
+		author, err := e.Author()
+		require.NoError(t, err)
+		if string(e.Value) == "alice" {
+			require.Equal(t, dhts[1].self, author)
+		} else {
+			require.Equal(t, dhts[2].self, author)
+		}
+	}
+
+	// readers union the sets of the peers
+	key = "/group/split"
+	for i, member := range []string{"carol", "dave"} {
+		d := dhts[i+1]
+		e := SetEntry{Value: []byte(member)}
+		e.PublicKey, err = ci.MarshalPublicKey(d.peerstore.PubKey(d.self))
+		require.NoError(t, err)
+		e.Signature, err = d.peerstore.PrivKey(d.self).Sign(e.signedBytes(key))
+		require.NoError(t, err)
+		rec := record.MakePutRecord(key, MarshalSetValue([]SetEntry{e}))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, d.putLocal(key, rec))
+	}
+	entries, err = dhts[0].GetSetEntries(ctx, key)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"carol", "dave"}, entryValues(entries))
+
+	// entries don't fit in full sets
+	key = "/group/full"
+	for _, member := range []string{"a", "b", "c"} {
+		require.NoError(t, dhts[1].AddSetEntry(ctx, key, []byte(member)))
+	}
+	require.True(t, errors.Is(dhts[1].AddSetEntry(ctx, key, []byte("d")), ErrSetFull))
+	e := SetEntry{Value: []byte("d")}
+	e.PublicKey, err = ci.MarshalPublicKey(dhts[0].peerstore.PubKey(dhts[0].self))
+	require.NoError(t, err)
+	e.Signature, err = dhts[0].peerstore.PrivKey(dhts[0].self).Sign(e.signedBytes(key))
+	require.NoError(t, err)
+	require.Error(t, dhts[0].PutValueToPeer(ctx, dhts[1].self, key, MarshalSetValue([]SetEntry{e})))
+	rec, err := dhts[1].getLocal(key)
+	require.NoError(t, err)
+	entries, err = UnmarshalSetValue(rec.GetValue())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b", "c"}, entryValues(entries))
+
+	// entries are signed by their author
+	v := SetValidator{}
+	require.NoError(t, v.Validate(key, rec.GetValue()))
+	entries[0].Value = []byte("mallory")
+	require.Error(t, v.Validate(key, MarshalSetValue(entries)))
+}
+
+func TestPrivateProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 4
+	dhts := setupConnectedDHTS(t, ctx, nDHTs, EnablePrivateProviders())
+
+	// private records are opt-in
+	c := testCaseCids[0]
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	require.Equal(t, routing.ErrNotSupported, d.ProvidePrivate(ctx, c))
+	_, err := d.FindProvidersPrivate(ctx, c)
+	require.Equal(t, routing.ErrNotSupported, err)
+
+	require.NoError(t, dhts[1].ProvidePrivate(ctx, c))
+	require.NoError(t, dhts[2].ProvidePrivate(ctx, c))
+
+	// holders of the cid find both providers
+	provs, err := dhts[3].FindProvidersPrivate(ctx, c)
+	require.NoError(t, err)
+	var ids []peer.ID
+	for _, p := range provs {
+		ids = append(ids, p.ID)
+		require.NotEmpty(t, p.Addrs)
+	}
+	require.ElementsMatch(t, []peer.ID{dhts[1].self, dhts[2].self}, ids)
+
+	// the records are stored under the double hash only, and can't be read without the cid
+	rec, err := dhts[0].getLocal(PrivateProvidersKey(c.Hash()))
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	require.NotContains(t, string(rec.GetKey()), string(c.Hash()))
+	entries, err := unmarshalPrivateProviders(rec.GetValue())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	aead, err := privateProvidersCipher(testCaseCids[1].Hash())
+	require.NoError(t, err)
+	_, err = openPrivateProvider(aead, testCaseCids[1].Hash(), entries[0])
+	require.Error(t, err)
+
+	// providing again replaces the record of the provider
+	require.NoError(t, dhts[1].ProvidePrivate(ctx, c))
+	rec, err = dhts[0].getLocal(PrivateProvidersKey(c.Hash()))
+	require.NoError(t, err)
+	entries, err = unmarshalPrivateProviders(rec.GetValue())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// records can't outlive the provide validity
+	e, err := dhts[1].sealPrivateProvider(c.Hash(), time.Now().Add(2*providers.ProvideValidity))
+	require.NoError(t, err)
+	require.Error(t, dhts[1].PutValue(ctx, PrivateProvidersKey(c.Hash()), marshalPrivateProviders([]privateProviderEntry{e})))
+
+	// full sets evict the records expiring first
+	var full []privateProviderEntry
+	for i := 0; i < maxPrivateProviders; i++ {
+		full = append(full, privateProviderEntry{
+			expiry:     time.Now().Add(time.Duration(i+1) * time.Minute),
+			tag:        privateProviderTag(c.Hash(), peer.ID(fmt.Sprint("provider", i))),
+			ciphertext: []byte{byte(i)},
+		})
+	}
+	newest := privateProviderEntry{
+		expiry:     time.Now().Add(providers.ProvideValidity),
+		tag:        privateProviderTag(c.Hash(), "newest provider"),
+		ciphertext: []byte("newest"),
+	}
+	merged, err := PrivateProvidersValidator{}.Merge("", [][]byte{
+		marshalPrivateProviders(full), marshalPrivateProviders([]privateProviderEntry{newest}),
+	})
+	require.NoError(t, err)
+	entries, err = unmarshalPrivateProviders(merged)
+	require.NoError(t, err)
+	require.Len(t, entries, maxPrivateProviders)
+	require.Equal(t, newest.ciphertext, entries[0].ciphertext)
+	for _, e := range entries {
+		require.NotEqual(t, full[0].ciphertext, e.ciphertext)
+	}
+
+	// a put can't flood the stored records, nor evict the ones expiring as late as its own
+	var flood []privateProviderEntry
+	for i := 0; i < maxPrivateProviders; i++ {
+		flood = append(flood, privateProviderEntry{
+			expiry:     full[len(full)-1].expiry,
+			tag:        privateProviderTag(c.Hash(), peer.ID(fmt.Sprint("flooder", i))),
+			ciphertext: []byte("junk"),
+		})
+	}
+	merged, err = PrivateProvidersValidator{}.Merge("", [][]byte{marshalPrivateProviders(full), marshalPrivateProviders(flood)})
+	require.NoError(t, err)
+	entries, err = unmarshalPrivateProviders(merged)
+	require.NoError(t, err)
+	junk := 0
+	for _, e := range entries {
+		if string(e.ciphertext) == "junk" {
+			junk++
+		}
+	}
+	require.Equal(t, maxPrivateProvidersPerMerge, junk)
+	stored := make([]privateProviderEntry, maxPrivateProviders)
+	for i := range stored {
+		stored[i] = full[len(full)-1]
+		stored[i].tag = privateProviderTag(c.Hash(), peer.ID(fmt.Sprint("stored provider", i)))
+	}
+	merged, err = PrivateProvidersValidator{}.Merge("", [][]byte{marshalPrivateProviders(stored), marshalPrivateProviders(flood)})
+	require.NoError(t, err)
+	require.Equal(t, marshalPrivateProviders(stored), merged)
+
+	// private records live alongside the regular ones
+	_, err = dhts[3].FindProvidersPrivate(ctx, testCaseCids[1])
+	require.Equal(t, routing.ErrNotFound, err)
+	provs, err = dhts[3].FindProviders(ctx, c)
+	require.NoError(t, err)
+	require.Empty(t, provs)
+	require.NoError(t, dhts[1].Provide(ctx, c, true))
+	provs, err = dhts[3].FindProviders(ctx, c)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+}
+
 func TestInvalidMessageSenderTracking(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -592,6 +1246,49 @@ func TestInvalidMessageSenderTracking(t *testing.T) {
 	}
 }
 
+func TestMessageSenderPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requester := setupDHT(ctx, t, false, MaxMessageSenders(2), MessageSenderIdleTimeout(500*time.Millisecond))
+	peers := setupDHTS(t, ctx, 3)
+	for _, d := range peers {
+		requester.Host().Peerstore().AddAddrs(d.PeerID(), d.Host().Addrs(), peerstore.AddressTTL)
+	}
+
+	for i := 0; i < 2; i++ {
+		for _, d := range peers {
+			require.NoError(t, requester.Ping(ctx, d.PeerID()))
+		}
+	}
+
+	stats := requester.MessageSenderStats()
+	assert.Equal(t, 2, stats.Open)
+	assert.Equal(t, uint64(6), stats.Created+stats.Reused)
+	assert.Equal(t, stats.Created-2, stats.Evicted)
+
+	// reuse the most recently used sender
+	require.NoError(t, requester.Ping(ctx, peers[2].PeerID()))
+	stats = requester.MessageSenderStats()
+	assert.Equal(t, uint64(1), stats.Reused)
+	assert.InDelta(t, 1.0/7, stats.ReuseRate(), 0.001)
+
+	require.Eventually(t, func() bool {
+		return requester.MessageSenderStats().Open == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, uint64(2), requester.MessageSenderStats().Reaped)
+
+	// senders in use are not reaped
+	ms, err := requester.messageSenderForPeer(ctx, peers[0].PeerID())
+	require.NoError(t, err)
+	time.Sleep(time.Second)
+	assert.Equal(t, 1, requester.MessageSenderStats().Open)
+	requester.releaseMessageSender(ms)
+	require.Eventually(t, func() bool {
+		return requester.MessageSenderStats().Open == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
 func TestProvides(t *testing.T) {
 	// t.Skip("skipping test to debug another")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1078,6 +1775,33 @@ func TestProvidesAsync(t *testing.T) {
 	}
 }
 
+func TestOptimisticProvide(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupRingDHTS(t, ctx, nDHTs, 3, BucketSize(5), EnableOptimisticProvide(), OptimisticProvideReturnRatio(0.6))
+
+	provider := dhts[0]
+	key := testCaseCids[0]
+	require.NoError(t, provider.Provide(ctx, key, true))
+
+	stored := func() int {
+		n := 0
+		for _, d := range dhts[1:] {
+			for _, p := range d.ProviderManager.GetProviders(ctx, key.Hash()) {
+				if p == provider.self {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	// 3 of the 5 closest peers store the record by the time Provide returns, the others follow in the background.
+	require.Eventually(t, func() bool { return stored() >= 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return stored() >= 5 }, 10*time.Second, 10*time.Millisecond)
+}
+
 func TestLayeredGet(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1504,6 +2228,373 @@ func TestFindClosestPeers(t *testing.T) {
 	}
 }
 
+func TestGetClosestPeersDetailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+
+	querier := dhts[1]
+	res, err := querier.GetClosestPeersDetailed(ctx, "foo")
+	require.NoError(t, err)
+	require.True(t, res.Completed)
+	require.GreaterOrEqual(t, len(res.Peers), querier.beta)
+
+	key := kb.ConvertKey("foo")
+	require.Equal(t, querier.routingTable.SortClosestPeers(res.PeerIDs(), key), res.PeerIDs())
+	for _, p := range res.Peers {
+		require.NotEmpty(t, p.Addrs)
+		require.Equal(t, kb.CommonPrefixLen(kb.ConvertPeerID(p.ID), key), p.CPL)
+		if p.State == qpeerset.PeerQueried {
+			require.NotZero(t, p.RTT)
+		}
+	}
+}
+
+func TestLookupSeedPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 20
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	// the querier isn't connected to anyone
+	for i := 1; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i%(nDHTs-1))+1])
+	}
+	querier := dhts[0]
+
+	_, err := querier.GetClosestPeersDetailed(ctx, "foo")
+	require.Equal(t, kb.ErrLookupFailure, err)
+
+	seed := peer.AddrInfo{ID: dhts[5].self, Addrs: dhts[5].host.Addrs()}
+	res, err := querier.GetClosestPeersDetailed(ctx, "foo", LookupSeedPeers(seed))
+	require.NoError(t, err)
+	require.True(t, res.Completed)
+	require.GreaterOrEqual(t, len(res.Peers), querier.beta)
+}
+
+func TestSinglePeerRPCs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
+	dhtC := setupDHT(ctx, t, false)
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtC.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+	defer dhtC.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+	connect(t, ctx, dhtB, dhtC)
+
+	// the value is only stored at B
+	require.NoError(t, dhtA.PutValueToPeer(ctx, dhtB.self, "/v/hello", []byte("world")))
+	rec, err := dhtB.getLocal("/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), rec.GetValue())
+	rec, err = dhtA.getLocal("/v/hello")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+
+	vres, err := dhtA.GetValueFromPeer(ctx, dhtB.self, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), vres.Record.GetValue())
+
+	vres, err = dhtA.GetValueFromPeer(ctx, dhtB.self, "/v/missing")
+	require.NoError(t, err)
+	require.Nil(t, vres.Record)
+
+	// invalid records are rejected with the reason
+	pkkey := routing.KeyForPublicKey(dhtC.self)
+	bad := record.MakePutRecord(pkkey, []byte("junk"))
+	bad.TimeReceived = u.FormatRFC3339(time.Now())
+	require.NoError(t, dhtB.putLocal(pkkey, bad))
+	_, err = dhtA.GetValueFromPeer(ctx, dhtB.self, pkkey)
+	require.True(t, errors.Is(err, errInvalidRecord))
+	require.NotEqual(t, errInvalidRecord.Error(), err.Error())
+
+	closer, err := dhtA.GetClosestPeersFromPeer(ctx, dhtB.self, "foo")
+	require.NoError(t, err)
+	require.Len(t, closer, 1)
+	require.Equal(t, dhtC.self, closer[0].ID)
+
+	key, err := multihash.Sum([]byte("provided"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, dhtA.ProvideToPeer(ctx, dhtB.self, key))
+	require.Eventually(t, func() bool {
+		pres, err := dhtC.GetProvidersFromPeer(ctx, dhtB.self, key)
+		return err == nil && len(pres.Providers) == 1 && pres.Providers[0].ID == dhtA.self
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 5
+	dhts := setupDHTS(t, ctx, nDHTs, NegativeCache(time.Minute))
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+	querier := dhts[0]
+
+	t.Run("values", func(t *testing.T) {
+		_, err := querier.GetValue(ctx, "/v/missing")
+		require.Equal(t, routing.ErrNotFound, err)
+		require.True(t, querier.negativeCache.has(negativeCacheValue, "/v/missing"))
+
+		// the value is stored at another peer, but we remember it doesn't exist
+		require.NoError(t, dhts[1].PutValueToPeer(ctx, dhts[2].self, "/v/missing", []byte("found")))
+		_, err = querier.GetValue(ctx, "/v/missing")
+		require.Equal(t, routing.ErrNotFound, err)
+
+		val, err := querier.GetValue(ctx, "/v/missing", BypassNegativeCache())
+		require.NoError(t, err)
+		require.Equal(t, []byte("found"), val)
+
+		_, err = querier.GetValue(ctx, "/v/other")
+		require.Equal(t, routing.ErrNotFound, err)
+		require.NoError(t, querier.PutValue(ctx, "/v/other", []byte("put")))
+		require.False(t, querier.negativeCache.has(negativeCacheValue, "/v/other"))
+	})
+
+	t.Run("providers", func(t *testing.T) {
+		c := testCaseCids[0]
+		provs, err := querier.FindProviders(ctx, c)
+		require.NoError(t, err)
+		require.Empty(t, provs)
+		require.True(t, querier.negativeCache.has(negativeCacheProviders, string(c.Hash())))
+
+		// the key is provided to another peer, but we remember it has no providers
+		require.NoError(t, dhts[2].ProvideToPeer(ctx, dhts[3].self, c.Hash()))
+		require.Eventually(t, func() bool {
+			res, err := dhts[2].GetProvidersFromPeer(ctx, dhts[3].self, c.Hash())
+			return err == nil && len(res.Providers) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		provs, err = querier.FindProviders(ctx, c)
+		require.NoError(t, err)
+		require.Empty(t, provs)
+
+		provs, err = querier.FindProviders(WithRoutingOptions(ctx, BypassNegativeCache()), c)
+		require.NoError(t, err)
+		require.Len(t, provs, 1)
+
+		require.NoError(t, querier.Provide(ctx, c, false))
+		require.False(t, querier.negativeCache.has(negativeCacheProviders, string(c.Hash())))
+	})
+
+	t.Run("peers", func(t *testing.T) {
+		id, err := querier.routingTable.GenRandPeerID(0)
+		require.NoError(t, err)
+		_, err = querier.FindPeer(ctx, id)
+		require.Equal(t, routing.ErrNotFound, err)
+		require.True(t, querier.negativeCache.has(negativeCachePeer, string(id)))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		c := newNegativeCache(50 * time.Millisecond)
+		for i := 0; i <= maxNegativeCacheEntries; i++ {
+			c.add(negativeCacheValue, fmt.Sprint(i))
+		}
+		require.Len(t, c.entries, maxNegativeCacheEntries)
+		require.False(t, c.has(negativeCacheValue, "0"), "the entry expiring first should have been evicted")
+		require.True(t, c.has(negativeCacheValue, "1"))
+
+		time.Sleep(100 * time.Millisecond)
+		c.sweep()
+		require.Empty(t, c.entries)
+		require.Zero(t, c.order.Len())
+	})
+}
+
+func TestDisjointPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupRingDHTS(t, ctx, nDHTs, 3)
+
+	querier := dhts[1]
+	evtCtx, evtCancel := context.WithCancel(ctx)
+	evtCtx, events := RegisterForLookupEvents(evtCtx)
+	paths := make(map[peer.ID]int)
+	overlaps := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			var update *LookupUpdateEvent
+			switch {
+			case e.Request != nil:
+				update = e.Request
+			case e.Response != nil:
+				update = e.Response
+			default:
+				continue
+			}
+			for _, ps := range [][]*PeerKadID{update.Heard, update.Waiting, update.Queried} {
+				for _, p := range ps {
+					if path, ok := paths[p.Peer]; ok && path != e.Path {
+						overlaps++
+					}
+					paths[p.Peer] = e.Path
+				}
+			}
+		}
+	}()
+
+	peers, err := querier.GetClosestPeers(WithRoutingOptions(evtCtx, LookupDisjointPaths(3)), "foo")
+	require.NoError(t, err)
+	var out []peer.ID
+	for p := range peers {
+		out = append(out, p)
+	}
+	evtCancel()
+	<-done
+
+	require.GreaterOrEqual(t, len(out), querier.beta)
+	require.Zero(t, overlaps, "a peer was used by more than one disjoint path")
+	seen := make(map[int]struct{})
+	for _, path := range paths {
+		seen[path] = struct{}{}
+	}
+	require.Len(t, seen, 3)
+}
+
+func TestLookupOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupRingDHTS(t, ctx, nDHTs, 3)
+	querier := dhts[1]
+
+	peers, err := querier.GetClosestPeers(WithRoutingOptions(ctx, LookupResultSize(3), LookupConcurrency(1), LookupResiliency(1)), "foo")
+	require.NoError(t, err)
+	require.Len(t, peers, 3)
+
+	evtCtx, evtCancel := context.WithCancel(ctx)
+	evtCtx, events := RegisterForLookupEvents(evtCtx)
+	contacted := make(map[peer.ID]struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			if e.Request != nil {
+				for _, p := range e.Request.Waiting {
+					contacted[p.Peer] = struct{}{}
+				}
+			}
+		}
+	}()
+	_, err = querier.GetClosestPeers(WithRoutingOptions(evtCtx, LookupMaxPeers(2)), "bar")
+	require.NoError(t, err)
+	evtCancel()
+	<-done
+	require.Len(t, contacted, 2)
+
+	_, err = querier.FindPeer(WithRoutingOptions(ctx, LookupConcurrency(0)), dhts[20].self)
+	require.Error(t, err)
+}
+
+func TestNetworkSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupRingDHTS(t, ctx, nDHTs, 3, BucketSize(5))
+
+	querier := dhts[1]
+	_, err := querier.NetworkSize()
+	require.Equal(t, netsize.ErrNotEnoughData, err)
+
+	for i := 0; i < 10; i++ {
+		peers, err := querier.GetClosestPeers(ctx, fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+		for range peers {
+		}
+	}
+
+	size, err := querier.NetworkSize()
+	require.NoError(t, err)
+	t.Logf("estimated network size: %d (actual %d)", size, nDHTs)
+	// the estimate is noisy on such a small network, but within a factor of two of the actual size
+	require.GreaterOrEqual(t, size, nDHTs/2)
+	require.LessOrEqual(t, size, 2*nDHTs)
+}
+
+func TestLookupHandle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupRingDHTS(t, ctx, nDHTs, 3)
+	querier := dhts[1]
+
+	l, err := querier.LookupClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	res, err := l.Wait()
+	require.NoError(t, err)
+	require.True(t, res.Completed)
+	require.Contains(t, []LookupTerminationReason{LookupCompleted, LookupStarvation}, res.Reason)
+	require.NotEmpty(t, res.Peers)
+	require.LessOrEqual(t, len(res.Peers), querier.bucketSize)
+	require.Len(t, res.States, len(res.Peers))
+
+	progress := l.Progress()
+	require.Equal(t, res.Peers, progress.Peers)
+	require.Equal(t, res.Elapsed, progress.Elapsed)
+	require.GreaterOrEqual(t, progress.Queried, querier.beta)
+
+	// cancel a lookup once it queried its first peer
+	evtCtx, evtCancel := context.WithCancel(ctx)
+	defer evtCancel()
+	evtCtx, events := RegisterForLookupEvents(evtCtx)
+	l, err = querier.LookupClosestPeers(evtCtx, "bar")
+	require.NoError(t, err)
+	for e := range events {
+		if e.Request != nil {
+			l.Cancel()
+			break
+		}
+	}
+	go func() {
+		for range events {
+		}
+	}()
+	res, err = l.Wait()
+	require.NoError(t, err)
+	require.False(t, res.Completed)
+	require.Equal(t, LookupCancelled, res.Reason)
+}
+
 func TestFixLowPeers(t *testing.T) {
 	ctx := context.Background()
 
@@ -1739,6 +2830,67 @@ func TestPing(t *testing.T) {
 	assert.NoError(t, ds[0].Ping(context.Background(), ds[1].PeerID()))
 }
 
+func TestRequestPipelining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requester := setupDHT(ctx, t, false, EnableRequestPipelining())
+	pipelined := setupDHT(ctx, t, false, EnableRequestPipelining())
+	legacy := setupDHT(ctx, t, false)
+
+	for _, d := range []*IpfsDHT{pipelined, legacy} {
+		requester.Host().Peerstore().AddAddrs(d.PeerID(), d.Host().Addrs(), peerstore.AddressTTL)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < cap(errs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- requester.Ping(ctx, d.PeerID())
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	}
+
+	requester.smlk.Lock()
+	defer requester.smlk.Unlock()
+	assert.NotNil(t, requester.strmap[pipelined.PeerID()].pipeline, "expected a pipelined stream")
+	assert.Nil(t, requester.strmap[legacy.PeerID()].pipeline, "expected to fall back to an unpipelined stream")
+}
+
+func TestReadTimeouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false,
+		ReadMessageTimeout(5*time.Second),
+		ReadMessageTimeoutForType(pb.Message_GET_PROVIDERS, 20*time.Second),
+		AdaptiveReadMessageTimeout(4, time.Second, 30*time.Second),
+	)
+
+	p := peer.ID("fast")
+	assert.Equal(t, 5*time.Second, d.readTimeout(p, pb.Message_FIND_NODE))
+	assert.Equal(t, 20*time.Second, d.readTimeout(p, pb.Message_GET_PROVIDERS))
+
+	d.peerstore.RecordLatency(p, 100*time.Millisecond)
+	assert.Equal(t, time.Second, d.readTimeout(p, pb.Message_FIND_NODE))
+	// timeouts configured for a type take precedence
+	assert.Equal(t, 20*time.Second, d.readTimeout(p, pb.Message_GET_PROVIDERS))
+
+	slow := peer.ID("slow")
+	d.peerstore.RecordLatency(slow, 5*time.Second)
+	assert.Equal(t, 20*time.Second, d.readTimeout(slow, pb.Message_FIND_NODE))
+
+	satellite := peer.ID("satellite")
+	d.peerstore.RecordLatency(satellite, 12*time.Second)
+	assert.Equal(t, 30*time.Second, d.readTimeout(satellite, pb.Message_FIND_NODE))
+}
+
 func TestClientModeAtInit(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
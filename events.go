@@ -85,6 +85,9 @@ type LookupEvent struct {
 	ID uuid.UUID
 	// Key is the Kademlia key used as a lookup target.
 	Key *KeyKadID
+	// Path is the index of the disjoint path of the lookup that emitted the event, and therefore the path the peers
+	// in the event belong to. It is always 0 for lookups that don't use disjoint paths.
+	Path int
 	// Request, if not nil, describes a state update event, associated with an outgoing query request.
 	Request *LookupUpdateEvent
 	// Response, if not nil, describes a state update event, associated with an outgoing query response.
@@ -127,6 +130,8 @@ type LookupUpdateEvent struct {
 	Queried []*PeerKadID
 	// Unreachable is a set of peers whose state in the lookup's peerset is being set to "unreachable".
 	Unreachable []*PeerKadID
+	// Slow is a set of peers whose state in the lookup's peerset is being set to "slow".
+	Slow []*PeerKadID
 }
 
 // LookupTerminateEvent describes a lookup termination event.
@@ -158,6 +163,8 @@ func (r LookupTerminationReason) String() string {
 		return "starvation"
 	case LookupCompleted:
 		return "completed"
+	case LookupBudgetExhausted:
+		return "budget exhausted"
 	}
 	panic("unreachable")
 }
@@ -171,6 +178,8 @@ const (
 	LookupStarvation
 	// LookupCompleted indicates that the lookup terminated successfully, reaching the Kademlia end condition.
 	LookupCompleted
+	// LookupBudgetExhausted indicates that the lookup ran out of peers, queries, hops or time it was allowed to use.
+	LookupBudgetExhausted
 )
 
 type routingLookupKey struct{}
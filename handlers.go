@@ -9,6 +9,7 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/routing"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 
 	"github.com/gogo/protobuf/proto"
@@ -65,6 +66,14 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	if err != nil {
 		return nil, err
 	}
+	// always serve our own public key, even once the stored record expired
+	if rec == nil && string(k) == routing.KeyForPublicKey(dht.self) {
+		if rec, err = dht.selfPublicKeyRecord(); err != nil {
+			logger.Warnw("failed to make own public key record", "error", err)
+		} else if err = dht.putLocal(string(k), rec); err != nil {
+			logger.Warnw("failed to store own public key record", "error", err)
+		}
+	}
 	resp.Record = rec
 
 	// Find closest peer on given cluster to desired key and reply with that info
@@ -192,7 +201,16 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
-	if existing != nil {
+	if mv := dht.mergingValidator(string(rec.GetKey())); existing != nil && mv != nil {
+		// merge the new value into the stored one, the put fails if it doesn't fit
+		merged, err := mv.Merge(string(rec.GetKey()), [][]byte{existing.GetValue(), rec.GetValue()})
+		if err != nil {
+			logger.Warnw("dht record passed validation but failed merge", "from", p, "key", loggableRecordKeyBytes(rec.GetKey()), "error", err)
+			return nil, err
+		}
+		// store the merged value, the response echoes the put one
+		rec = &recpb.Record{Key: rec.GetKey(), Value: merged}
+	} else if existing != nil {
 		recs := [][]byte{rec.GetValue(), existing.GetValue()}
 		i, err := dht.Validator.Select(string(rec.GetKey()), recs)
 		if err != nil {
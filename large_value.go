@@ -0,0 +1,345 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// defaultLargeValueChunkSize is the default size of the chunks large values are split into.
+	defaultLargeValueChunkSize = 1 << 20
+	// maxLargeValueChunkSize leaves room in a message for the record and the closer peers around a chunk.
+	maxLargeValueChunkSize = network.MessageSizeMax / 2
+	// largeValueConcurrency is the number of chunks of a large value stored or fetched at the same time.
+	largeValueConcurrency = 8
+)
+
+// manifestPrefix starts every encoded Manifest.
+const manifestPrefix = "/dht-manifest/1\n"
+
+// Manifest describes a large value stored with PutLargeValue: the value is the concatenation of the chunks stored
+// under the ChunkKey of their hash. The manifest itself is stored under the ManifestKey of its hash.
+type Manifest struct {
+	// Size is the size of the value.
+	Size uint64
+	// Hash is the SHA2-256 multihash of the value.
+	Hash multihash.Multihash
+	// Chunks are the SHA2-256 multihashes of the chunks, in order.
+	Chunks []multihash.Multihash
+}
+
+// Marshal encodes the manifest.
+func (m *Manifest) Marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(manifestPrefix)
+	writeUvarint(&buf, m.Size)
+	writeLengthPrefixed(&buf, m.Hash)
+	writeUvarint(&buf, uint64(len(m.Chunks)))
+	for _, c := range m.Chunks {
+		writeLengthPrefixed(&buf, c)
+	}
+	return buf.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeLengthPrefixed(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+// readLengthPrefixed reads bytes written with writeLengthPrefixed.
+func readLengthPrefixed(r *bytes.Reader) ([]byte, bool) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return nil, false
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+var errInvalidManifest = errors.New("invalid large value manifest")
+
+// UnmarshalManifest decodes a manifest encoded with Manifest.Marshal.
+func UnmarshalManifest(data []byte) (*Manifest, error) {
+	if !bytes.HasPrefix(data, []byte(manifestPrefix)) {
+		return nil, errInvalidManifest
+	}
+	r := bytes.NewReader(data[len(manifestPrefix):])
+	readMultihash := func() (multihash.Multihash, error) {
+		b, ok := readLengthPrefixed(r)
+		if !ok {
+			return nil, errInvalidManifest
+		}
+		mh, err := multihash.Cast(b)
+		if err != nil {
+			return nil, errInvalidManifest
+		}
+		return mh, nil
+	}
+
+	m := new(Manifest)
+	var err error
+	if m.Size, err = binary.ReadUvarint(r); err != nil {
+		return nil, errInvalidManifest
+	}
+	if m.Hash, err = readMultihash(); err != nil {
+		return nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	// every chunk takes at least a byte
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errInvalidManifest
+	}
+	m.Chunks = make([]multihash.Multihash, 0, n)
+	for i := uint64(0); i < n; i++ {
+		c, err := readMultihash()
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, c)
+	}
+	if r.Len() != 0 {
+		return nil, errInvalidManifest
+	}
+	return m, nil
+}
+
+// ManifestKey returns the key the manifest is stored under, in the "manifest" namespace: the key commits to the
+// manifest, and therefore to the value.
+func ManifestKey(m *Manifest) string {
+	mh, err := multihash.Sum(m.Marshal(), multihash.SHA2_256, -1)
+	if err != nil {
+		// SHA2-256 is always supported
+		panic(err)
+	}
+	return "/manifest/" + string(mh)
+}
+
+// ManifestValidator is the record.Validator of the "manifest" namespace: the value of a manifest key must be a well
+// formed manifest that hashes to the multihash in the key.
+type ManifestValidator struct{}
+
+var _ record.Validator = ManifestValidator{}
+
+// Validate checks that the value is a well formed manifest that hashes to the multihash of the key.
+func (ManifestValidator) Validate(key string, value []byte) error {
+	if err := validateHashKey("manifest", key, value); err != nil {
+		return err
+	}
+	_, err := UnmarshalManifest(value)
+	return err
+}
+
+// Select selects the first value, all the valid values of a manifest key are equal.
+func (ManifestValidator) Select(_ string, _ [][]byte) (int, error) {
+	return 0, nil
+}
+
+// ChunkKey returns the key a chunk with the given multihash is stored under, in the "chunk" namespace.
+func ChunkKey(mh multihash.Multihash) string {
+	return "/chunk/" + string(mh)
+}
+
+// ChunkValidator is the record.Validator of the "chunk" namespace: the value of a chunk key must hash to the
+// multihash in the key.
+type ChunkValidator struct{}
+
+var _ record.Validator = ChunkValidator{}
+
+// Validate checks that the value hashes to the multihash of the key.
+func (ChunkValidator) Validate(key string, value []byte) error {
+	return validateHashKey("chunk", key, value)
+}
+
+// Select selects the first value, all the valid values of a chunk key are equal.
+func (ChunkValidator) Select(_ string, _ [][]byte) (int, error) {
+	return 0, nil
+}
+
+// validateHashKey checks that the key is in the namespace ns, and that the value hashes to the multihash of the key.
+func validateHashKey(ns string, key string, value []byte) error {
+	keyNs, rest, err := record.SplitKey(key)
+	if err != nil {
+		return err
+	}
+	if keyNs != ns {
+		return fmt.Errorf("key not in %s namespace", ns)
+	}
+	mh, err := multihash.Cast([]byte(rest))
+	if err != nil {
+		return err
+	}
+	decoded, err := multihash.Decode(mh)
+	if err != nil {
+		return err
+	}
+	sum, err := multihash.Sum(value, decoded.Code, decoded.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, mh) {
+		return fmt.Errorf("%s does not match its key", ns)
+	}
+	return nil
+}
+
+// PutLargeValue stores a value that may not fit in a single message: the value is split into chunks (see
+// LargeValueChunkSize) stored under the ChunkKey of their hash, and a Manifest of the chunks is stored under its
+// ManifestKey, which PutLargeValue returns. The key commits to the value: to give the value a mutable name, store the
+// key under the name, e.g. with PutSignedValue.
+//
+// The chunks and manifests are validated by ChunkValidator and ManifestValidator, which the DHT only uses by default
+// with a custom protocol prefix: the public IPFS DHT doesn't accept the "chunk" and "manifest" namespaces.
+func (dht *IpfsDHT) PutLargeValue(ctx context.Context, value []byte, opts ...routing.Option) (string, error) {
+	if !dht.enableValues {
+		return "", routing.ErrNotSupported
+	}
+
+	hash, err := multihash.Sum(value, multihash.SHA2_256, -1)
+	if err != nil {
+		return "", err
+	}
+	m := &Manifest{Size: uint64(len(value)), Hash: hash}
+	var chunks [][]byte
+	for start := 0; start < len(value); start += dht.largeValueChunkSize {
+		end := start + dht.largeValueChunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk := value[start:end]
+		mh, err := multihash.Sum(chunk, multihash.SHA2_256, -1)
+		if err != nil {
+			return "", err
+		}
+		m.Chunks = append(m.Chunks, mh)
+		chunks = append(chunks, chunk)
+	}
+
+	err = dht.forEachChunk(ctx, len(chunks), func(ctx context.Context, i int) error {
+		return dht.PutValue(ctx, ChunkKey(m.Chunks[i]), chunks[i], opts...)
+	})
+	if err != nil {
+		return "", err
+	}
+	key := ManifestKey(m)
+	if err := dht.PutValue(ctx, key, m.Marshal(), opts...); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// GetLargeValue fetches a value stored with PutLargeValue: the manifest under the manifest key, with GetValue, then
+// its chunks in parallel. The value is checked against the manifest, and values larger than maxSize bytes are
+// rejected before their chunks are fetched.
+func (dht *IpfsDHT) GetLargeValue(ctx context.Context, key string, maxSize uint64, opts ...routing.Option) ([]byte, error) {
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+
+	data, err := dht.GetValue(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m, err := UnmarshalManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.Size > maxSize {
+		return nil, fmt.Errorf("large value has size %d, more than the maximum of %d", m.Size, maxSize)
+	}
+	// every chunk holds at least a byte, and at most a message
+	if uint64(len(m.Chunks)) > m.Size || uint64(len(m.Chunks))*network.MessageSizeMax < m.Size {
+		return nil, fmt.Errorf("large value of size %d can't have %d chunks", m.Size, len(m.Chunks))
+	}
+
+	// chunks are immutable, any valid value will do
+	chunkOpts := append(append([]routing.Option(nil), opts...), Quorum(1))
+	chunks := make([][]byte, len(m.Chunks))
+	var received uint64
+	err = dht.forEachChunk(ctx, len(m.Chunks), func(ctx context.Context, i int) error {
+		chunk, err := dht.GetValue(ctx, ChunkKey(m.Chunks[i]), chunkOpts...)
+		if err != nil {
+			return fmt.Errorf("failed to fetch chunk %d: %w", i, err)
+		}
+		if atomic.AddUint64(&received, uint64(len(chunk))) > m.Size {
+			return fmt.Errorf("large value chunks are larger than the manifest size %d", m.Size)
+		}
+		chunks[i] = chunk
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value := bytes.Join(chunks, nil)
+	if uint64(len(value)) != m.Size {
+		return nil, fmt.Errorf("large value has size %d, manifest says %d", len(value), m.Size)
+	}
+	decoded, err := multihash.Decode(m.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if sum, err := multihash.Sum(value, decoded.Code, decoded.Length); err != nil || !bytes.Equal(sum, m.Hash) {
+		return nil, errors.New("large value does not match its manifest")
+	}
+	return value, nil
+}
+
+// forEachChunk runs f for the chunks 0 to n-1, largeValueConcurrency at a time, and returns the first error. The
+// context f gets is cancelled after an error.
+func (dht *IpfsDHT) forEachChunk(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	slots := make(chan struct{}, largeValueConcurrency)
+	for i := 0; i < n; i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := f(ctx, i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -3,12 +3,14 @@ package dht
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 )
 
@@ -17,53 +19,269 @@ import (
 //
 // If the context is canceled, this function will return the context error along
 // with the closest K peers it has found so far.
+//
+// The lookup parameters can be overridden with routing options attached to the
+// context with WithRoutingOptions, e.g. LookupResultSize.
+//
+// See GetClosestPeersDetailed for the addresses and lookup states of the peers.
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan peer.ID, error) {
-	if key == "" {
-		return nil, fmt.Errorf("can't lookup empty key")
+	l, err := dht.LookupClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
 	}
-	//TODO: I can break the interface! return []peer.ID
-	lookupRes, err := dht.runLookupWithFollowup(ctx, key,
-		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
-			// For DHT query command
-			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
-				Type: routing.SendingQuery,
-				ID:   p,
-			})
-
-			pmes, err := dht.findPeerSingle(ctx, p, peer.ID(key))
-			if err != nil {
-				logger.Debugf("error getting closer peers: %s", err)
-				return nil, err
-			}
-			peers := pb.PBPeersToPeerInfos(pmes.GetCloserPeers())
-
-			// For DHT query command
-			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
-				Type:      routing.PeerResponse,
-				ID:        p,
-				Responses: peers,
-			})
-
-			return peers, err
-		},
-		func() bool { return false },
-	)
-
+	res, err := l.Wait()
 	if err != nil {
 		return nil, err
 	}
 
-	out := make(chan peer.ID, dht.bucketSize)
+	out := make(chan peer.ID, len(res.Peers))
 	defer close(out)
 
-	for _, p := range lookupRes.peers {
+	for _, p := range res.Peers {
 		out <- p
 	}
 
-	if ctx.Err() == nil && lookupRes.completed {
-		// refresh the cpl for this key as the query was successful
-		dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(key), time.Now())
+	return out, ctx.Err()
+}
+
+// ClosestPeer is one of the closest peers to a key found by GetClosestPeersDetailed.
+type ClosestPeer struct {
+	peer.AddrInfo
+	// CPL is the length of the common prefix of the peer's and the key's Kademlia IDs.
+	CPL int
+	// State is the state of the peer at the end of the lookup.
+	State qpeerset.PeerState
+	// RTT is the time the peer took to respond to the lookup, 0 if the lookup didn't query it.
+	RTT time.Duration
+}
+
+// ClosestPeersResult is the result of GetClosestPeersDetailed.
+type ClosestPeersResult struct {
+	// Peers are the closest peers to the key that are not known to be unreachable, closest first.
+	Peers []ClosestPeer
+	// Completed tells whether the lookup ran until the Kademlia end condition, rather than being interrupted.
+	Completed bool
+	// Reason is the reason the lookup terminated for, LookupStarvation if it ran out of peers to query.
+	Reason LookupTerminationReason
+}
+
+// PeerIDs returns the IDs of the peers in the result, closest first.
+func (r *ClosestPeersResult) PeerIDs() []peer.ID {
+	ids := make([]peer.ID, len(r.Peers))
+	for i, p := range r.Peers {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+// GetClosestPeersDetailed is a Kademlia 'node lookup' operation, like GetClosestPeers. It returns the K closest peers
+// to the given key ordered by XOR distance, along with their addresses, their state at the end of the lookup and how
+// they responded, and how the lookup ended.
+//
+// If the context is canceled, this function will return the context error along
+// with the closest K peers it has found so far.
+//
+// The routing options, if any, override the lookup parameters (e.g. LookupResultSize).
+func (dht *IpfsDHT) GetClosestPeersDetailed(ctx context.Context, key string, opts ...routing.Option) (*ClosestPeersResult, error) {
+	l, err := dht.LookupClosestPeers(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := l.Wait()
+	if err != nil {
+		return nil, err
 	}
 
+	out := &ClosestPeersResult{
+		Peers:     make([]ClosestPeer, len(res.Peers)),
+		Completed: res.Completed,
+		Reason:    res.Reason,
+	}
+	for i, p := range res.Peers {
+		out.Peers[i] = ClosestPeer{
+			AddrInfo: dht.peerstore.PeerInfo(p),
+			CPL:      kb.CommonPrefixLen(kb.ConvertPeerID(p), l.target),
+			State:    res.States[i],
+			RTT:      res.RTTs[i],
+		}
+	}
 	return out, ctx.Err()
 }
+
+// Lookup is a handle on a lookup of the closest peers to a key started with LookupClosestPeers.
+type Lookup struct {
+	dht        *IpfsDHT
+	target     kb.ID
+	resultSize int
+	start      time.Time
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mu    sync.Mutex
+	paths []*query // nil until the lookup started querying peers
+
+	// set once done is closed
+	res     *LookupResult
+	err     error
+	elapsed time.Duration
+}
+
+// LookupProgress is a snapshot of a lookup in progress.
+type LookupProgress struct {
+	// Peers are the closest peers to the key found so far that are not known to be unreachable, closest first.
+	Peers []peer.ID
+	// States are the states of Peers in the lookup.
+	States []qpeerset.PeerState
+	// Queried is the number of peers that responded so far.
+	Queried int
+	// Unreachable is the number of peers that failed to respond so far.
+	Unreachable int
+	// Elapsed is the time since the lookup started.
+	Elapsed time.Duration
+}
+
+// LookupResult is the result of a lookup.
+type LookupResult struct {
+	// Peers are the closest peers to the key that are not known to be unreachable, closest first.
+	Peers []peer.ID
+	// States are the states of Peers at the end of the lookup.
+	States []qpeerset.PeerState
+	// RTTs are the times Peers took to respond to the lookup, 0 for the peers the lookup didn't query.
+	RTTs []time.Duration
+	// Completed tells whether the lookup ran until the Kademlia end condition, rather than being interrupted.
+	Completed bool
+	// Reason is the reason the lookup terminated for.
+	Reason LookupTerminationReason
+	// Elapsed is the time the lookup took.
+	Elapsed time.Duration
+}
+
+// LookupClosestPeers starts a Kademlia 'node lookup' of the K closest peers to the given key, like GetClosestPeers,
+// and returns a handle to follow its progress, cancel it, and wait for its result.
+//
+// The routing options, if any, override the lookup parameters (e.g. LookupResultSize or LookupMaxDuration).
+func (dht *IpfsDHT) LookupClosestPeers(ctx context.Context, key string, opts ...routing.Option) (*Lookup, error) {
+	if key == "" {
+		return nil, fmt.Errorf("can't lookup empty key")
+	}
+	params, err := dht.lookupParams(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	l := &Lookup{
+		dht:        dht,
+		target:     kb.ConvertKey(key),
+		resultSize: params.resultSize,
+		start:      time.Now(),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	params.handle = l
+
+	go func() {
+		defer cancel()
+		lookupRes, err := dht.runLookupWithFollowupParams(ctx, key,
+			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+				// For DHT query command
+				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+					Type: routing.SendingQuery,
+					ID:   p,
+				})
+
+				pmes, err := dht.findPeerSingle(ctx, p, peer.ID(key))
+				if err != nil {
+					logger.Debugf("error getting closer peers: %s", err)
+					return nil, err
+				}
+				peers := pb.PBPeersToPeerInfos(pmes.GetCloserPeers())
+
+				// For DHT query command
+				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+					Type:      routing.PeerResponse,
+					ID:        p,
+					Responses: peers,
+				})
+
+				return peers, err
+			},
+			func() bool { return false },
+			params,
+		)
+
+		if err == nil && ctx.Err() == nil && lookupRes.completed {
+			// refresh the cpl for this key as the query was successful
+			dht.routingTable.ResetCplRefreshedAtForID(l.target, time.Now())
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.elapsed = time.Since(l.start)
+		l.err = err
+		if err == nil {
+			l.res = &LookupResult{
+				Peers:     lookupRes.peers,
+				States:    lookupRes.state,
+				RTTs:      lookupRes.rtt,
+				Completed: lookupRes.completed,
+				Reason:    lookupRes.reason,
+				Elapsed:   l.elapsed,
+			}
+		}
+		close(l.done)
+	}()
+
+	return l, nil
+}
+
+func (l *Lookup) setPaths(paths []*query) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paths = paths
+}
+
+// Progress returns a snapshot of the lookup, which keeps running.
+func (l *Lookup) Progress() LookupProgress {
+	l.mu.Lock()
+	paths := l.paths
+	elapsed := time.Since(l.start)
+	select {
+	case <-l.done:
+		elapsed = l.elapsed
+	default:
+	}
+	l.mu.Unlock()
+
+	progress := LookupProgress{Elapsed: elapsed}
+	if paths == nil {
+		return progress
+	}
+	res := l.dht.constructLookupResult(paths, l.target, l.resultSize)
+	progress.Peers, progress.States = res.peers, res.state
+	for _, q := range paths {
+		q.mu.Lock()
+		progress.Queried += q.queryPeers.NumQueried()
+		progress.Unreachable += q.queryPeers.NumUnreachable()
+		q.mu.Unlock()
+	}
+	return progress
+}
+
+// Cancel aborts the lookup. Wait then returns the closest peers found so far.
+func (l *Lookup) Cancel() {
+	l.cancel()
+}
+
+// Done returns a channel that is closed once the lookup is over.
+func (l *Lookup) Done() <-chan struct{} {
+	return l.done
+}
+
+// Wait waits for the lookup to be over and returns its result.
+func (l *Lookup) Wait() (*LookupResult, error) {
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.res, l.err
+}
@@ -0,0 +1,302 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// sharedLookupKey identifies the lookups concurrent callers can share: the lookups of the same kind for the same key
+// that produce the same results.
+type sharedLookupKey struct {
+	kind  string
+	key   string
+	count int
+}
+
+// sharedLookups deduplicates concurrent lookups: a caller attaches to the running lookup with the same
+// sharedLookupKey, if any, instead of starting its own.
+type sharedLookups struct {
+	mu      sync.Mutex
+	running map[sharedLookupKey]*sharedLookup
+}
+
+func newSharedLookups() *sharedLookups {
+	return &sharedLookups{running: make(map[sharedLookupKey]*sharedLookup)}
+}
+
+// sharedLookup is a lookup shared by the callers attached to it. Its results are kept until it finishes, so that
+// callers attaching late still receive all of them, in order.
+type sharedLookup struct {
+	owner *sharedLookups
+	key   sharedLookupKey
+
+	// ctx is the context of the lookup, it is cancelled once all callers detached.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stop is closed once none of the attached callers wants more results.
+	stop chan struct{}
+
+	mu      sync.Mutex
+	results []interface{}
+	// updated is closed and replaced every time a result is published or the lookup finishes.
+	updated   chan struct{}
+	done      bool
+	lookupRes *lookupWithFollowupResult
+	// attached is the number of attached callers, active the number of those that still want results.
+	attached int
+	active   int
+}
+
+// join attaches the caller to the running lookup for the key, or starts run as a new shared lookup. run must
+// publish the results of the lookup and finish it. The caller must leave the lookup once done with it.
+func (s *sharedLookups) join(parent context.Context, key sharedLookupKey, run func(sl *sharedLookup)) *sharedLookup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sl, ok := s.running[key]; ok {
+		sl.mu.Lock()
+		joinable := !sl.done && sl.attached > 0 && sl.active > 0
+		if joinable {
+			sl.attached++
+			sl.active++
+		}
+		sl.mu.Unlock()
+		if joinable {
+			return sl
+		}
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	sl := &sharedLookup{
+		owner:    s,
+		key:      key,
+		ctx:      ctx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+		updated:  make(chan struct{}),
+		attached: 1,
+		active:   1,
+	}
+	s.running[key] = sl
+
+	go func() {
+		defer cancel()
+		run(sl)
+		sl.finish(nil)
+	}()
+	return sl
+}
+
+func (s *sharedLookups) remove(sl *sharedLookup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[sl.key] == sl {
+		delete(s.running, sl.key)
+	}
+}
+
+// publish makes a result available to the attached callers.
+func (sl *sharedLookup) publish(r interface{}) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.results = append(sl.results, r)
+	close(sl.updated)
+	sl.updated = make(chan struct{})
+}
+
+// finish marks the lookup as done with the given result, if it isn't done already.
+func (sl *sharedLookup) finish(lookupRes *lookupWithFollowupResult) {
+	sl.mu.Lock()
+	if !sl.done {
+		sl.done = true
+		sl.lookupRes = lookupRes
+		close(sl.updated)
+	}
+	sl.mu.Unlock()
+	sl.owner.remove(sl)
+}
+
+// next waits for the i-th result of the lookup. It returns false if the lookup finished without producing it, or if
+// the context is done or stop is closed first.
+func (sl *sharedLookup) next(ctx context.Context, stop <-chan struct{}, i int) (interface{}, bool) {
+	for {
+		sl.mu.Lock()
+		if i < len(sl.results) {
+			r := sl.results[i]
+			sl.mu.Unlock()
+			return r, true
+		}
+		if sl.done {
+			sl.mu.Unlock()
+			return nil, false
+		}
+		updated := sl.updated
+		sl.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-stop:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// wait waits for the lookup to finish and returns its result, nil if the context is done first.
+func (sl *sharedLookup) wait(ctx context.Context) *lookupWithFollowupResult {
+	for {
+		sl.mu.Lock()
+		if sl.done {
+			sl.mu.Unlock()
+			return sl.lookupRes
+		}
+		updated := sl.updated
+		sl.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// deactivate tells the lookup that a caller doesn't want more results. It returns true if it was the last one, in
+// which case the lookup is stopped.
+func (sl *sharedLookup) deactivate() bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.deactivateLocked()
+}
+
+func (sl *sharedLookup) deactivateLocked() bool {
+	sl.active--
+	if sl.active == 0 {
+		close(sl.stop)
+		return true
+	}
+	return false
+}
+
+// leave detaches a caller, that is still active unless it deactivated. The lookup is cancelled once all callers left.
+func (sl *sharedLookup) leave(active bool) {
+	sl.mu.Lock()
+	sl.attached--
+	if active {
+		sl.deactivateLocked()
+	}
+	abandoned := sl.attached == 0 && !sl.done
+	sl.mu.Unlock()
+
+	if abandoned {
+		sl.cancel()
+		sl.owner.remove(sl)
+	}
+}
+
+// canShareLookup tells whether the lookup of a call can be shared with the concurrent calls for the same key. Calls
+// that override the lookup parameters or whose events are followed get their own lookup.
+func (dht *IpfsDHT) canShareLookup(ctx context.Context, opts []routing.Option) bool {
+	if !dht.enableLookupSharing || len(routingOptionsFromContext(ctx)) > 0 {
+		return false
+	}
+	if routing.SubscribesToQueryEvents(ctx) || ctx.Value(routingLookupKey{}) != nil {
+		return false
+	}
+
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return false
+	}
+	for k := range cfg.Other {
+		switch k.(type) {
+		case quorumOptionKey, valueResolutionOptionKey:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// getValuesShared is getValues for a lookup shared with the concurrent calls for the same key. The lookup result is
+// only sent to the callers that are still active when the lookup ends, so that callers stopping early don't wait for
+// the others.
+func (dht *IpfsDHT) getValuesShared(ctx context.Context, key string, stopQuery chan struct{}) (<-chan RecvdVal, <-chan *lookupWithFollowupResult) {
+	valCh := make(chan RecvdVal, 1)
+	lookupResCh := make(chan *lookupWithFollowupResult, 1)
+
+	sl := dht.sharedLookups.join(dht.ctx, sharedLookupKey{kind: "value", key: key}, func(sl *sharedLookup) {
+		vals, lookupRes := dht.getValuesUnshared(sl.ctx, key, sl.stop, nil)
+		for v := range vals {
+			sl.publish(v)
+		}
+		sl.finish(<-lookupRes)
+	})
+
+	go func() {
+		defer close(valCh)
+		defer close(lookupResCh)
+
+		for i := 0; ; i++ {
+			r, ok := sl.next(ctx, stopQuery, i)
+			if !ok {
+				break
+			}
+			select {
+			case valCh <- r.(RecvdVal):
+			case <-stopQuery:
+			case <-ctx.Done():
+			}
+		}
+
+		select {
+		case <-stopQuery:
+			last := sl.deactivate()
+			defer sl.leave(false)
+			if !last {
+				return
+			}
+		default:
+			defer sl.leave(true)
+		}
+
+		if lookupRes := sl.wait(ctx); lookupRes != nil {
+			lookupResCh <- lookupRes
+		}
+	}()
+
+	return valCh, lookupResCh
+}
+
+// findProvidersShared is findProvidersAsyncRoutine for a lookup shared with the concurrent calls for the same key
+// and count.
+func (dht *IpfsDHT) findProvidersShared(ctx context.Context, key multihash.Multihash, count int, peerOut chan peer.AddrInfo) {
+	defer close(peerOut)
+
+	sl := dht.sharedLookups.join(dht.ctx, sharedLookupKey{kind: "providers", key: string(key), count: count}, func(sl *sharedLookup) {
+		provs := make(chan peer.AddrInfo)
+		go dht.findProvidersAsyncRoutine(sl.ctx, key, count, provs)
+		for p := range provs {
+			sl.publish(p)
+		}
+	})
+	defer sl.leave(true)
+
+	for i := 0; ; i++ {
+		r, ok := sl.next(ctx, nil, i)
+		if !ok {
+			return
+		}
+		select {
+		case peerOut <- r.(peer.AddrInfo):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
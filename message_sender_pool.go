@@ -0,0 +1,157 @@
+package dht
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// MessageSenderStats describes how the DHT reuses the streams it opens to other peers.
+type MessageSenderStats struct {
+	// Open is the number of message senders currently held, one per peer we have recently talked to.
+	Open int
+	// Created is the number of message senders that have been created.
+	Created uint64
+	// Reused is the number of requests and messages that were sent with an existing message sender.
+	Reused uint64
+	// Reopened is the number of times a message sender had to open a new stream to its peer, e.g. because the peer
+	// reset the previous one or because the stream stopped being reused.
+	Reopened uint64
+	// Evicted is the number of message senders that were closed because MaxMessageSenders was reached.
+	Evicted uint64
+	// Reaped is the number of message senders that were closed because they were idle for longer than the
+	// MessageSenderIdleTimeout.
+	Reaped uint64
+}
+
+// ReuseRate returns the fraction of requests and messages that were sent with an existing message sender.
+func (s MessageSenderStats) ReuseRate() float64 {
+	total := s.Created + s.Reused
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Reused) / float64(total)
+}
+
+// messageSenderCounters are the MessageSenderStats counters protected by dht.smlk.
+type messageSenderCounters struct {
+	Created, Reused, Evicted, Reaped uint64
+}
+
+// MessageSenderStats returns statistics about the message senders (and therefore streams) the DHT keeps open to
+// other peers.
+func (dht *IpfsDHT) MessageSenderStats() MessageSenderStats {
+	dht.smlk.Lock()
+	defer dht.smlk.Unlock()
+	return MessageSenderStats{
+		Open:     len(dht.strmap),
+		Created:  dht.smStats.Created,
+		Reused:   dht.smStats.Reused,
+		Reopened: atomic.LoadUint64(&dht.smReopened),
+		Evicted:  dht.smStats.Evicted,
+		Reaped:   dht.smStats.Reaped,
+	}
+}
+
+// addMessageSender adds ms to the set of message senders as the most recently used one, evicting the least recently
+// used senders that are not in use if there are more than maxMessageSenders.
+// The caller must hold dht.smlk.
+func (dht *IpfsDHT) addMessageSender(ms *messageSender) {
+	ms.lastUsed = time.Now()
+	ms.elem = dht.strlru.PushFront(ms)
+	dht.strmap[ms.p] = ms
+
+	if dht.maxMessageSenders <= 0 {
+		return
+	}
+	for e := dht.strlru.Back(); e != nil && len(dht.strmap) > dht.maxMessageSenders; {
+		oldest := e.Value.(*messageSender)
+		e = e.Prev()
+		if oldest.inUse > 0 {
+			continue
+		}
+		dht.removeMessageSender(oldest.p)
+		dht.closeMessageSender(oldest)
+		dht.smStats.Evicted++
+	}
+}
+
+// acquireMessageSender marks ms as the most recently used message sender, and as in use until it is released with
+// releaseMessageSender.
+// The caller must hold dht.smlk.
+func (dht *IpfsDHT) acquireMessageSender(ms *messageSender) {
+	ms.inUse++
+	ms.lastUsed = time.Now()
+	dht.strlru.MoveToFront(ms.elem)
+}
+
+// releaseMessageSender marks ms as the most recently used message sender once a request or message sent with it is
+// done.
+func (dht *IpfsDHT) releaseMessageSender(ms *messageSender) {
+	dht.smlk.Lock()
+	defer dht.smlk.Unlock()
+	ms.inUse--
+	ms.lastUsed = time.Now()
+	if dht.strmap[ms.p] == ms {
+		dht.strlru.MoveToFront(ms.elem)
+	}
+}
+
+// removeMessageSender removes the message sender for peer p from the set of message senders, without closing it.
+// The caller must hold dht.smlk.
+func (dht *IpfsDHT) removeMessageSender(p peer.ID) (*messageSender, bool) {
+	ms, ok := dht.strmap[p]
+	if !ok {
+		return nil, false
+	}
+	delete(dht.strmap, p)
+	dht.strlru.Remove(ms.elem)
+	return ms, true
+}
+
+// closeMessageSender invalidates a message sender that has been removed from the set of message senders, closing
+// its stream.
+func (dht *IpfsDHT) closeMessageSender(ms *messageSender) {
+	// Do this asynchronously as ms.lk can block for a while.
+	go func() {
+		if err := ms.lk.Lock(dht.Context()); err != nil {
+			return
+		}
+		defer ms.lk.Unlock()
+		ms.invalidate()
+	}()
+}
+
+// reapIdleMessageSenders periodically closes the message senders that are not in use and haven't been used for
+// messageSenderIdleTimeout.
+func (dht *IpfsDHT) reapIdleMessageSenders(proc goprocess.Process) {
+	ticker := time.NewTicker(dht.messageSenderIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+
+		cutoff := time.Now().Add(-dht.messageSenderIdleTimeout)
+		dht.smlk.Lock()
+		for e := dht.strlru.Back(); e != nil; {
+			ms := e.Value.(*messageSender)
+			e = e.Prev()
+			if ms.inUse > 0 {
+				continue
+			}
+			if ms.lastUsed.After(cutoff) {
+				break
+			}
+			dht.removeMessageSender(ms.p)
+			dht.closeMessageSender(ms)
+			dht.smStats.Reaped++
+		}
+		dht.smlk.Unlock()
+	}
+}
@@ -19,6 +19,8 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID, _ = tag.NewKey("instance_id")
+	// KeyRepairOutcome is the outcome of a read-repair.
+	KeyRepairOutcome, _ = tag.NewKey("repair_outcome")
 )
 
 // UpsertMessageType is a convenience upserts the message type
@@ -39,6 +41,9 @@ var (
 	SentRequests           = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
 	SentRequestErrors      = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
 	SentBytes              = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+	NetworkSize            = stats.Int64("libp2p.io/dht/kad/network_size", "Estimated number of peers in the DHT network", stats.UnitDimensionless)
+	ReadRepairs            = stats.Int64("libp2p.io/dht/kad/read_repairs", "Total number of read-repairs per outcome", stats.UnitDimensionless)
+	StaleValues            = stats.Int64("libp2p.io/dht/kad/stale_values", "Total number of outdated values received", stats.UnitDimensionless)
 )
 
 // Views
@@ -93,6 +98,21 @@ var (
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	}
+	NetworkSizeView = &view.View{
+		Measure:     NetworkSize,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	ReadRepairsView = &view.View{
+		Measure:     ReadRepairs,
+		TagKeys:     []tag.Key{KeyRepairOutcome, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	StaleValuesView = &view.View{
+		Measure:     StaleValues,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
 )
 
 // DefaultViews with all views in it.
@@ -107,4 +127,7 @@ var DefaultViews = []*view.View{
 	SentRequestsView,
 	SentRequestErrorsView,
 	SentBytesView,
+	NetworkSizeView,
+	ReadRepairsView,
+	StaleValuesView,
 }
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// negativeCacheOp is the operation a negative cache entry is for.
+type negativeCacheOp int
+
+const (
+	negativeCacheValue negativeCacheOp = iota
+	negativeCacheProviders
+	negativeCachePeer
+)
+
+type negativeCacheKey struct {
+	op  negativeCacheOp
+	key string
+}
+
+// maxNegativeCacheEntries is the maximum number of keys the negative cache remembers, the entries expiring first are
+// evicted beyond that.
+const maxNegativeCacheEntries = 10000
+
+// negativeCache remembers the keys completed lookups found nothing for, so that the lookups aren't repeated until the
+// entries expire.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[negativeCacheKey]*list.Element
+	// order holds the *negativeCacheEntry values by expiry, soonest first: all the entries have the same ttl.
+	order *list.List
+}
+
+type negativeCacheEntry struct {
+	key     negativeCacheKey
+	expires time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[negativeCacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// add records that nothing was found for the key.
+func (c *negativeCache) add(op negativeCacheOp, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := negativeCacheKey{op, key}
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*negativeCacheEntry).expires = expires
+		c.order.MoveToBack(e)
+		return
+	}
+	c.entries[k] = c.order.PushBack(&negativeCacheEntry{key: k, expires: expires})
+	for len(c.entries) > maxNegativeCacheEntries {
+		c.removeElementLocked(c.order.Front())
+	}
+}
+
+// has tells whether nothing was found for the key recently.
+func (c *negativeCache) has(op negativeCacheOp, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[negativeCacheKey{op, key}]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.Value.(*negativeCacheEntry).expires) {
+		c.removeElementLocked(e)
+		return false
+	}
+	return true
+}
+
+// remove forgets that nothing was found for the key.
+func (c *negativeCache) remove(op negativeCacheOp, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[negativeCacheKey{op, key}]; ok {
+		c.removeElementLocked(e)
+	}
+}
+
+// sweep drops the expired entries.
+func (c *negativeCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for e := c.order.Front(); e != nil && now.After(e.Value.(*negativeCacheEntry).expires); e = c.order.Front() {
+		c.removeElementLocked(e)
+	}
+}
+
+func (c *negativeCache) removeElementLocked(e *list.Element) {
+	delete(c.entries, e.Value.(*negativeCacheEntry).key)
+	c.order.Remove(e)
+}
+
+// sweepNegativeCache periodically drops the expired entries of the negative cache.
+func (dht *IpfsDHT) sweepNegativeCache(proc goprocess.Process) {
+	ticker := time.NewTicker(dht.negativeCache.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dht.negativeCache.sweep()
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// cachedNotFound tells whether a lookup for the key can be skipped because a recent one found nothing, unless the
+// call bypasses the negative cache.
+func (dht *IpfsDHT) cachedNotFound(ctx context.Context, op negativeCacheOp, key string, opts ...routing.Option) bool {
+	if dht.negativeCache == nil {
+		return false
+	}
+
+	var cfg routing.Options
+	if err := cfg.Apply(routingOptionsFromContext(ctx)...); err != nil {
+		return false
+	}
+	if err := cfg.Apply(opts...); err != nil {
+		return false
+	}
+	if getBypassNegativeCache(&cfg) {
+		return false
+	}
+	return dht.negativeCache.has(op, key)
+}
+
+// cacheNotFound records that a lookup for the key found nothing, if the lookup completed.
+func (dht *IpfsDHT) cacheNotFound(op negativeCacheOp, key string, lookupRes *lookupWithFollowupResult) {
+	if dht.negativeCache == nil || lookupRes == nil || !lookupRes.completed {
+		return
+	}
+	dht.negativeCache.add(op, key)
+}
+
+// invalidateNotFound forgets that a lookup for the key found nothing.
+func (dht *IpfsDHT) invalidateNotFound(op negativeCacheOp, key string) {
+	if dht.negativeCache == nil {
+		return
+	}
+	dht.negativeCache.remove(op, key)
+}
@@ -0,0 +1,143 @@
+// Package netsize estimates the number of peers in the DHT from the distances between lookup targets and the K
+// closest peers found by completed lookups.
+//
+// The IDs of the peers in the network are uniformly distributed over the key space, so the normalized distance
+// between a target and its i-th closest peer is expected to be i/(N+1) in a network of N peers. Every completed
+// lookup yields an estimate of N, fitted to the distances of its K closest peers by least squares, and the estimates
+// of recent lookups are averaged, with older estimates weighing less.
+package netsize
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// ErrNotEnoughData is returned when the estimator hasn't tracked enough lookups to estimate the network size.
+var ErrNotEnoughData = errors.New("not enough data to estimate the network size")
+
+// ErrNotEnoughPeers is returned when a lookup result has less than K peers and can't be tracked.
+var ErrNotEnoughPeers = errors.New("not enough peers to track the lookup")
+
+const (
+	// DefaultMaxMeasurements is the default number of most recent lookups the estimate is based on.
+	DefaultMaxMeasurements = 100
+	// DefaultHalfLife is the default age after which the estimate of a lookup counts half as much as a fresh one.
+	DefaultHalfLife = 30 * time.Minute
+
+	// minMeasurements is the number of lookups we need to have tracked before we estimate the network size.
+	minMeasurements = 5
+)
+
+type measurement struct {
+	size      float64
+	timestamp time.Time
+}
+
+// Estimator estimates the network size from the lookups it tracks.
+// It is safe for concurrent use.
+type Estimator struct {
+	bucketSize      int
+	maxMeasurements int
+	halfLife        time.Duration
+
+	// now returns the current time, tests override it.
+	now func() time.Time
+
+	mu           sync.Mutex
+	measurements []measurement // oldest first
+}
+
+// NewEstimator creates an estimator for a network with the given bucket size (K), basing the estimate on the
+// maxMeasurements most recent lookups, weighed by the given half life.
+func NewEstimator(bucketSize, maxMeasurements int, halfLife time.Duration) *Estimator {
+	return &Estimator{
+		bucketSize:      bucketSize,
+		maxMeasurements: maxMeasurements,
+		halfLife:        halfLife,
+		now:             time.Now,
+		measurements:    make([]measurement, 0, maxMeasurements),
+	}
+}
+
+// Track records the K closest peers found by a completed lookup for the given key.
+func (e *Estimator) Track(key string, peers []peer.ID) error {
+	size, err := Estimate(key, peers, e.bucketSize)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.measurements) == e.maxMeasurements {
+		copy(e.measurements, e.measurements[1:])
+		e.measurements = e.measurements[:len(e.measurements)-1]
+	}
+	e.measurements = append(e.measurements, measurement{size: size, timestamp: e.now()})
+	return nil
+}
+
+// Estimate estimates the network size from the bucketSize closest peers to the key among the given peers, without
+// tracking it. It can be used to estimate the network size from the peers discovered by a lookup still in progress.
+func Estimate(key string, peers []peer.ID, bucketSize int) (float64, error) {
+	if len(peers) < bucketSize {
+		return 0, ErrNotEnoughPeers
+	}
+
+	distances := make([]float64, len(peers))
+	for i, p := range peers {
+		distances[i] = NormedDistance(key, p)
+	}
+	sort.Float64s(distances)
+	distances = distances[:bucketSize]
+
+	// least squares fit of distances[i-1] = i/(N+1)
+	var sumSquares, sumWeighted float64
+	for i, d := range distances {
+		rank := float64(i + 1)
+		sumSquares += rank * rank
+		sumWeighted += rank * d
+	}
+	if sumWeighted == 0 {
+		return 0, ErrNotEnoughPeers
+	}
+	// the lookup found at least K peers, the network can't be any smaller.
+	return math.Max(sumSquares/sumWeighted-1, float64(bucketSize)), nil
+}
+
+// NetworkSize returns the estimated number of peers in the network.
+func (e *Estimator) NetworkSize() (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.measurements) < minMeasurements {
+		return 0, ErrNotEnoughData
+	}
+
+	now := e.now()
+	var sum, weights float64
+	for _, m := range e.measurements {
+		w := math.Exp2(-float64(now.Sub(m.timestamp)) / float64(e.halfLife))
+		sum += w * m.size
+		weights += w
+	}
+	if weights == 0 {
+		return 0, ErrNotEnoughData
+	}
+	return int(math.Round(sum / weights)), nil
+}
+
+// NormedDistance returns the distance between the key and the peer in the key space, normalized to [0, 1).
+func NormedDistance(key string, p peer.ID) float64 {
+	a, b := kb.ConvertKey(key), kb.ConvertPeerID(p)
+	var xor [8]byte
+	for i := range xor {
+		xor[i] = a[i] ^ b[i]
+	}
+	return float64(binary.BigEndian.Uint64(xor[:])) / math.Exp2(64)
+}
@@ -0,0 +1,63 @@
+package netsize
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimator(t *testing.T) {
+	const (
+		networkSize = 2000
+		bucketSize  = 20
+	)
+
+	peers := make([]peer.ID, networkSize)
+	for i := range peers {
+		peers[i] = test.RandPeerIDFatal(t)
+	}
+
+	e := NewEstimator(bucketSize, DefaultMaxMeasurements, DefaultHalfLife)
+	_, err := e.NetworkSize()
+	require.Equal(t, ErrNotEnoughData, err)
+	require.Equal(t, ErrNotEnoughPeers, e.Track("short", peers[:bucketSize-1]))
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		sort.Slice(peers, func(a, b int) bool { return kb.Closer(peers[a], peers[b], key) })
+		require.NoError(t, e.Track(key, peers[:bucketSize]))
+	}
+
+	size, err := e.NetworkSize()
+	require.NoError(t, err)
+	require.InDelta(t, networkSize, size, networkSize*0.25)
+}
+
+func TestEstimatorPrefersRecentLookups(t *testing.T) {
+	const bucketSize = 20
+
+	now := time.Now()
+	e := NewEstimator(bucketSize, DefaultMaxMeasurements, time.Minute)
+	e.now = func() time.Time { return now }
+
+	// lookups in a small network a long time ago...
+	for i := 0; i < 10; i++ {
+		e.measurements = append(e.measurements, measurement{size: 100, timestamp: now.Add(-time.Hour)})
+	}
+	// ...and recent lookups in a much larger one.
+	for i := 0; i < 10; i++ {
+		e.measurements = append(e.measurements, measurement{size: 10000, timestamp: now})
+	}
+
+	size, err := e.NetworkSize()
+	require.NoError(t, err)
+	require.InDelta(t, 10000, size, 1)
+}
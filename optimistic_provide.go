@@ -0,0 +1,178 @@
+package dht
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/netsize"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// optimisticProvider stores a provider record on the peers of a lookup that are likely among the K closest peers to
+// the key as soon as they respond, instead of waiting for the lookup to complete.
+type optimisticProvider struct {
+	dht *IpfsDHT
+	ctx context.Context
+	key string
+	mes *pb.Message
+
+	// required is the number of peers that must store the record before Provide returns.
+	required int
+	// enough is closed once required peers stored the record.
+	enough chan struct{}
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	discovered map[peer.ID]struct{}
+	stored     map[peer.ID]struct{} // peers we sent the record to, successfully or not
+	successes  int
+}
+
+// optimisticProvide announces to the network that we are providing the key without waiting for the lookup of the
+// closest peers to complete. It returns as soon as enough of the peers likely to be among the K closest to the key
+// stored the record (see OptimisticProvideReturnRatio), while the lookup goes on in the background and stores the
+// record on the remaining closest peers.
+func (dht *IpfsDHT) optimisticProvide(ctx context.Context, keyMH []byte) error {
+	mes, err := dht.makeProvRecord(keyMH)
+	if err != nil {
+		return err
+	}
+
+	// The lookup outlives this call, so it can't use the caller's context.
+	lookupCtx, cancel := context.WithCancel(dht.Context())
+	op := &optimisticProvider{
+		dht:        dht,
+		ctx:        lookupCtx,
+		key:        string(keyMH),
+		mes:        mes,
+		required:   int(math.Ceil(dht.optimisticProvideReturnRatio * float64(dht.bucketSize))),
+		enough:     make(chan struct{}),
+		discovered: make(map[peer.ID]struct{}),
+		stored:     make(map[peer.ID]struct{}),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer cancel()
+		done <- op.run()
+	}()
+
+	select {
+	case <-op.enough:
+		return nil
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+func (op *optimisticProvider) run() error {
+	dht := op.dht
+	lookupRes, err := dht.runQuery(op.ctx, op.key,
+		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+			// For DHT query command
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type: routing.SendingQuery,
+				ID:   p,
+			})
+
+			pmes, err := dht.findPeerSingle(ctx, p, peer.ID(op.key))
+			if err != nil {
+				logger.Debugf("error getting closer peers: %s", err)
+				return nil, err
+			}
+			peers := pb.PBPeersToPeerInfos(pmes.GetCloserPeers())
+
+			// For DHT query command
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type:      routing.PeerResponse,
+				ID:        p,
+				Responses: peers,
+			})
+
+			// p responded, so it is reachable: store the record right away if it's likely one of the closest.
+			if op.discover(p, peers) {
+				op.store(p)
+			}
+			return peers, err
+		},
+		func() bool { return false },
+	)
+	if err != nil {
+		return err
+	}
+
+	// store the record on the closest peers the lookup found that we haven't stored it on yet.
+	for _, p := range lookupRes.peers {
+		op.store(p)
+	}
+	op.wg.Wait()
+
+	if op.ctx.Err() == nil && lookupRes.completed {
+		// refresh the cpl for this key as the query was successful
+		dht.routingTable.ResetCplRefreshedAtForID(kb.ConvertKey(op.key), time.Now())
+	}
+	return op.ctx.Err()
+}
+
+// discover records the peers learned from p and returns true if p is likely among the K closest peers to the key.
+func (op *optimisticProvider) discover(p peer.ID, learned []*peer.AddrInfo) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.discovered[p] = struct{}{}
+	for _, ai := range learned {
+		op.discovered[ai.ID] = struct{}{}
+	}
+
+	size, err := op.dht.NetworkSize()
+	n := float64(size)
+	if err != nil {
+		// we haven't seen enough lookups yet, estimate the network size from the peers discovered so far.
+		peers := make([]peer.ID, 0, len(op.discovered))
+		for dp := range op.discovered {
+			peers = append(peers, dp)
+		}
+		if n, err = netsize.Estimate(op.key, peers, op.dht.bucketSize); err != nil {
+			return false
+		}
+	}
+
+	// in a network of n peers, the K-th closest peer to the key is expected at a normalized distance of K/(n+1).
+	return netsize.NormedDistance(op.key, p) <= float64(op.dht.bucketSize)/(n+1)
+}
+
+// store sends the record to p in the background, unless we already sent it to p.
+func (op *optimisticProvider) store(p peer.ID) {
+	op.mu.Lock()
+	if _, ok := op.stored[p]; ok {
+		op.mu.Unlock()
+		return
+	}
+	op.stored[p] = struct{}{}
+	op.mu.Unlock()
+
+	op.wg.Add(1)
+	go func() {
+		defer op.wg.Done()
+		logger.Debugf("putProvider(%s, %s)", loggableProviderRecordBytes([]byte(op.key)), p)
+		if err := op.dht.sendMessage(op.ctx, p, op.mes); err != nil {
+			logger.Debug(err)
+			return
+		}
+
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		op.successes++
+		if op.successes == op.required {
+			close(op.enough)
+		}
+	}()
+}
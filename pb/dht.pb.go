@@ -114,10 +114,13 @@ type Message struct {
 	CloserPeers []Message_Peer `protobuf:"bytes,8,rep,name=closerPeers,proto3" json:"closerPeers"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers        []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	ProviderPeers []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
+	// Used to match responses to requests when several requests are in flight
+	// on a single pipelined stream. Zero on streams that are not pipelined.
+	RequestId            uint64   `protobuf:"varint,11,opt,name=requestId,proto3" json:"requestId,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -195,6 +198,13 @@ func (m *Message) GetProviderPeers() []Message_Peer {
 	return nil
 }
 
+func (m *Message) GetRequestId() uint64 {
+	if m != nil {
+		return m.RequestId
+	}
+	return 0
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id byteString `protobuf:"bytes,1,opt,name=id,proto3,customtype=byteString" json:"id"`
@@ -264,37 +274,38 @@ func init() {
 func init() { proto.RegisterFile("dht.proto", fileDescriptor_616a434b24c97ff4) }
 
 var fileDescriptor_616a434b24c97ff4 = []byte{
-	// 469 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xb1, 0x6f, 0x9b, 0x40,
-	0x18, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x03, 0x3b, 0xe4, 0x94, 0x01, 0xb9, 0x92, 0x83, 0x3c, 0xd1,
-	0xc1, 0x20, 0xd1, 0xb5, 0xaa, 0x6a, 0x03, 0x8d, 0x2c, 0xa5, 0xd8, 0xba, 0x38, 0xe9, 0x68, 0x19,
-	0xb8, 0x12, 0x54, 0xd7, 0x87, 0x00, 0xa7, 0xf2, 0xd6, 0x3f, 0x2f, 0x63, 0xe7, 0x0e, 0x51, 0xe5,
-	0xa9, 0x7f, 0x46, 0xc5, 0x11, 0x5a, 0xec, 0x25, 0x13, 0xef, 0x7d, 0xf7, 0x7e, 0xe2, 0xdd, 0xa7,
-	0x83, 0x4e, 0x74, 0x5f, 0x98, 0x69, 0xc6, 0x0a, 0x86, 0xdb, 0x5c, 0x06, 0x7d, 0x3b, 0x4e, 0x8a,
-	0xfb, 0x6d, 0x60, 0x86, 0xec, 0x9b, 0xb5, 0x4e, 0x82, 0xd4, 0x4e, 0xad, 0x98, 0x8d, 0x2a, 0x35,
-	0xca, 0x68, 0xc8, 0xb2, 0xc8, 0x4a, 0x03, 0xab, 0x52, 0x15, 0xdb, 0x1f, 0x35, 0x98, 0x98, 0xc5,
-	0xcc, 0xe2, 0xe3, 0x60, 0xfb, 0x85, 0x3b, 0x6e, 0xb8, 0xaa, 0xe2, 0xc3, 0x3f, 0x12, 0xbc, 0xfa,
-	0x44, 0xf3, 0x7c, 0x15, 0x53, 0x6c, 0x81, 0x54, 0xec, 0x52, 0xaa, 0x21, 0x1d, 0x19, 0x3d, 0xfb,
-	0xb5, 0x59, 0xb5, 0x30, 0x9f, 0x8f, 0xeb, 0xef, 0x62, 0x97, 0x52, 0xc2, 0x83, 0xd8, 0x80, 0xb3,
-	0x70, 0xbd, 0xcd, 0x0b, 0x9a, 0x5d, 0xd3, 0x07, 0xba, 0x26, 0xab, 0xef, 0x1a, 0xe8, 0xc8, 0x68,
-	0x91, 0xe3, 0x31, 0x56, 0x41, 0xfc, 0x4a, 0x77, 0x9a, 0xa0, 0x23, 0x43, 0x21, 0xa5, 0xc4, 0x6f,
-	0xa0, 0x5d, 0xf5, 0xd6, 0x44, 0x1d, 0x19, 0xb2, 0x7d, 0x6e, 0xd6, 0xd7, 0x08, 0x4c, 0xc2, 0x15,
-	0x79, 0x0e, 0xe0, 0x77, 0x20, 0x87, 0x6b, 0x96, 0xd3, 0x6c, 0x4e, 0x69, 0x96, 0x6b, 0xa7, 0xba,
-	0x68, 0xc8, 0xf6, 0xc5, 0x71, 0xbd, 0xf2, 0x70, 0x22, 0x3d, 0x3e, 0x5d, 0x9e, 0x90, 0x66, 0x1c,
-	0x7f, 0x80, 0x6e, 0x9a, 0xb1, 0x87, 0x24, 0xaa, 0xf9, 0xce, 0x8b, 0xfc, 0x21, 0xd0, 0xff, 0x81,
-	0x40, 0x2a, 0x15, 0x1e, 0x82, 0x90, 0x44, 0x7c, 0x3d, 0xca, 0x04, 0x97, 0xc9, 0x5f, 0x4f, 0x97,
-	0x10, 0xec, 0x0a, 0x7a, 0x53, 0x64, 0xc9, 0x26, 0x26, 0x42, 0x12, 0xe1, 0x0b, 0x68, 0xad, 0xa2,
-	0x28, 0xcb, 0x35, 0x41, 0x17, 0x0d, 0x85, 0x54, 0x06, 0xbf, 0x07, 0x08, 0xd9, 0x66, 0x43, 0xc3,
-	0x22, 0x61, 0x1b, 0x7e, 0xe3, 0x9e, 0x3d, 0x38, 0x6e, 0xe0, 0xfc, 0x4b, 0xf0, 0x1d, 0x37, 0x88,
-	0x61, 0x02, 0x72, 0x63, 0xfd, 0xb8, 0x0b, 0x9d, 0xf9, 0xed, 0x62, 0x79, 0x37, 0xbe, 0xbe, 0xf5,
-	0xd4, 0x93, 0xd2, 0x5e, 0x79, 0xb5, 0x45, 0x58, 0x05, 0x65, 0xec, 0xba, 0xcb, 0x39, 0x99, 0xdd,
-	0x4d, 0x5d, 0x8f, 0xa8, 0x02, 0x3e, 0x87, 0x6e, 0x19, 0xa8, 0x27, 0x37, 0xaa, 0x58, 0x32, 0x1f,
-	0xa7, 0xbe, 0xbb, 0xf4, 0x67, 0xae, 0xa7, 0x4a, 0xf8, 0x14, 0xa4, 0xf9, 0xd4, 0xbf, 0x52, 0x5b,
-	0xc3, 0xcf, 0xd0, 0x3b, 0x2c, 0x52, 0xd2, 0xfe, 0x6c, 0xb1, 0x74, 0x66, 0xbe, 0xef, 0x39, 0x0b,
-	0xcf, 0xad, 0xfe, 0xf8, 0xdf, 0x22, 0x7c, 0x06, 0xb2, 0x33, 0xf6, 0xeb, 0x84, 0x2a, 0x60, 0x0c,
-	0x3d, 0x67, 0xec, 0x37, 0x28, 0x55, 0x9c, 0x28, 0x8f, 0xfb, 0x01, 0xfa, 0xb9, 0x1f, 0xa0, 0xdf,
-	0xfb, 0x01, 0x0a, 0xda, 0xfc, 0xfd, 0xbd, 0xfd, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x8d, 0x1a, 0xa1,
-	0xbe, 0xf7, 0x02, 0x00, 0x00,
+	// 485 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0x31, 0x6f, 0x9b, 0x40,
+	0x1c, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x8f, 0xed, 0x90, 0x53, 0x06, 0xe4, 0x56, 0x0e, 0xf2, 0x44,
+	0x07, 0x83, 0x44, 0xd7, 0xaa, 0xaa, 0x6d, 0x68, 0x64, 0x29, 0xc5, 0xd6, 0xc5, 0x49, 0x47, 0xcb,
+	0xc0, 0x95, 0xa0, 0xba, 0x3e, 0x7a, 0xe0, 0x54, 0xde, 0x3a, 0xf5, 0xb3, 0x65, 0xec, 0xdc, 0x21,
+	0xaa, 0xfc, 0x49, 0x2a, 0x8e, 0xd0, 0x10, 0x2f, 0x9d, 0x78, 0xef, 0x7f, 0xef, 0x07, 0x8f, 0xbb,
+	0x83, 0x56, 0x74, 0x9b, 0x5b, 0x29, 0x67, 0x39, 0xc3, 0x4d, 0x21, 0x83, 0x9e, 0x13, 0x27, 0xf9,
+	0xed, 0x36, 0xb0, 0x42, 0xf6, 0xd5, 0x5e, 0x27, 0x41, 0xea, 0xa4, 0x76, 0xcc, 0x86, 0xa5, 0x1a,
+	0x72, 0x1a, 0x32, 0x1e, 0xd9, 0x69, 0x60, 0x97, 0xaa, 0x64, 0x7b, 0xc3, 0x1a, 0x13, 0xb3, 0x98,
+	0xd9, 0x62, 0x1c, 0x6c, 0x3f, 0x0b, 0x27, 0x8c, 0x50, 0x65, 0x7c, 0xf0, 0xb3, 0x01, 0x2f, 0x3e,
+	0xd2, 0x2c, 0x5b, 0xc5, 0x14, 0xdb, 0xa0, 0xe4, 0xbb, 0x94, 0xea, 0xc8, 0x40, 0x66, 0xd7, 0x79,
+	0x69, 0x95, 0x2d, 0xac, 0xc7, 0xe5, 0xea, 0xb9, 0xd8, 0xa5, 0x94, 0x88, 0x20, 0x36, 0xe1, 0x24,
+	0x5c, 0x6f, 0xb3, 0x9c, 0xf2, 0x4b, 0x7a, 0x47, 0xd7, 0x64, 0xf5, 0x5d, 0x07, 0x03, 0x99, 0x0d,
+	0x72, 0x38, 0xc6, 0x1a, 0xc8, 0x5f, 0xe8, 0x4e, 0x97, 0x0c, 0x64, 0xb6, 0x49, 0x21, 0xf1, 0x6b,
+	0x68, 0x96, 0xbd, 0x75, 0xd9, 0x40, 0xa6, 0xea, 0x9c, 0x5a, 0xd5, 0x6f, 0x04, 0x16, 0x11, 0x8a,
+	0x3c, 0x06, 0xf0, 0x5b, 0x50, 0xc3, 0x35, 0xcb, 0x28, 0x9f, 0x53, 0xca, 0x33, 0xfd, 0xd8, 0x90,
+	0x4d, 0xd5, 0x39, 0x3b, 0xac, 0x57, 0x2c, 0x8e, 0x95, 0xfb, 0x87, 0xf3, 0x23, 0x52, 0x8f, 0xe3,
+	0xf7, 0xd0, 0x49, 0x39, 0xbb, 0x4b, 0xa2, 0x8a, 0x6f, 0xfd, 0x97, 0x7f, 0x0e, 0xe0, 0x57, 0xd0,
+	0xe2, 0xf4, 0xdb, 0x96, 0x66, 0xf9, 0x34, 0xd2, 0x55, 0x03, 0x99, 0x0a, 0x79, 0x1a, 0xf4, 0x7e,
+	0x20, 0x50, 0x8a, 0x1c, 0x1e, 0x80, 0x94, 0x44, 0x62, 0xf3, 0xda, 0x63, 0x5c, 0xbc, 0xe7, 0xf7,
+	0xc3, 0x39, 0x04, 0xbb, 0x9c, 0x5e, 0xe5, 0x3c, 0xd9, 0xc4, 0x44, 0x4a, 0x22, 0x7c, 0x06, 0x8d,
+	0x55, 0x14, 0xf1, 0x4c, 0x97, 0x0c, 0xd9, 0x6c, 0x93, 0xd2, 0xe0, 0x77, 0x00, 0x21, 0xdb, 0x6c,
+	0x68, 0x98, 0x27, 0x6c, 0x23, 0xf6, 0xa3, 0xeb, 0xf4, 0x0f, 0xfb, 0x4d, 0xfe, 0x25, 0xc4, 0x09,
+	0xd4, 0x88, 0x41, 0x02, 0x6a, 0xed, 0x70, 0x70, 0x07, 0x5a, 0xf3, 0xeb, 0xc5, 0xf2, 0x66, 0x74,
+	0x79, 0xed, 0x69, 0x47, 0x85, 0xbd, 0xf0, 0x2a, 0x8b, 0xb0, 0x06, 0xed, 0x91, 0xeb, 0x2e, 0xe7,
+	0x64, 0x76, 0x33, 0x75, 0x3d, 0xa2, 0x49, 0xf8, 0x14, 0x3a, 0x45, 0xa0, 0x9a, 0x5c, 0x69, 0x72,
+	0xc1, 0x7c, 0x98, 0xfa, 0xee, 0xd2, 0x9f, 0xb9, 0x9e, 0xa6, 0xe0, 0x63, 0x50, 0xe6, 0x53, 0xff,
+	0x42, 0x6b, 0x0c, 0x3e, 0x41, 0xf7, 0x79, 0x91, 0x82, 0xf6, 0x67, 0x8b, 0xe5, 0x64, 0xe6, 0xfb,
+	0xde, 0x64, 0xe1, 0xb9, 0xe5, 0x17, 0x9f, 0x2c, 0xc2, 0x27, 0xa0, 0x4e, 0x46, 0x7e, 0x95, 0xd0,
+	0x24, 0x8c, 0xa1, 0x3b, 0x19, 0xf9, 0x35, 0x4a, 0x93, 0xc7, 0xed, 0xfb, 0x7d, 0x1f, 0xfd, 0xda,
+	0xf7, 0xd1, 0x9f, 0x7d, 0x1f, 0x05, 0x4d, 0x71, 0x3b, 0xdf, 0xfc, 0x1d, 0x00, 0x48, 0x80, 0xad,
+	0xc9, 0x15, 0x03, 0x00, 0x00,
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -321,6 +332,11 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.RequestId != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RequestId))
+		i--
+		dAtA[i] = 0x58
+	}
 	if m.ClusterLevelRaw != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.ClusterLevelRaw))
 		i--
@@ -475,6 +491,9 @@ func (m *Message) Size() (n int) {
 	if m.ClusterLevelRaw != 0 {
 		n += 1 + sovDht(uint64(m.ClusterLevelRaw))
 	}
+	if m.RequestId != 0 {
+		n += 1 + sovDht(uint64(m.RequestId))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -715,6 +734,25 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RequestId", wireType)
+			}
+			m.RequestId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RequestId |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDht(dAtA[iNdEx:])
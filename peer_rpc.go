@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	u "github.com/ipfs/go-ipfs-util"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/multiformats/go-multihash"
+)
+
+// This file implements the single-peer RPCs: requests sent to one specific peer, without a lookup.
+
+// PeerValueResponse is the response of a peer to GetValueFromPeer.
+type PeerValueResponse struct {
+	// Record is the record the peer stores for the key, nil if it has none.
+	Record *recpb.Record
+	// CloserPeers are the peers closer to the key the peer knows of.
+	CloserPeers []*peer.AddrInfo
+}
+
+// PeerProvidersResponse is the response of a peer to GetProvidersFromPeer.
+type PeerProvidersResponse struct {
+	// Providers are the providers of the key the peer knows of.
+	Providers []*peer.AddrInfo
+	// CloserPeers are the peers closer to the key the peer knows of.
+	CloserPeers []*peer.AddrInfo
+}
+
+// GetValueFromPeer asks the peer p for the record it stores for the key, without running a lookup. The record is
+// validated and an error is returned if it is invalid. A nil Record with no error means the peer doesn't have one.
+func (dht *IpfsDHT) GetValueFromPeer(ctx context.Context, p peer.ID, key string) (*PeerValueResponse, error) {
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+
+	pmes, err := dht.getValueSingle(ctx, p, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &PeerValueResponse{CloserPeers: pb.PBPeersToPeerInfos(pmes.GetCloserPeers())}
+	if rec := pmes.GetRecord(); rec != nil {
+		if string(rec.GetKey()) != key {
+			return res, fmt.Errorf("peer %s returned a record for another key", p)
+		}
+		if err := dht.Validator.Validate(key, rec.GetValue()); err != nil {
+			return res, fmt.Errorf("%w: %v", errInvalidRecord, err)
+		}
+		res.Record = rec
+	}
+	return res, nil
+}
+
+// GetClosestPeersFromPeer asks the peer p for the peers closest to the key it knows of, without running a lookup.
+func (dht *IpfsDHT) GetClosestPeersFromPeer(ctx context.Context, p peer.ID, key string) ([]*peer.AddrInfo, error) {
+	pmes, err := dht.findPeerSingle(ctx, p, peer.ID(key))
+	if err != nil {
+		return nil, err
+	}
+	return pb.PBPeersToPeerInfos(pmes.GetCloserPeers()), nil
+}
+
+// GetProvidersFromPeer asks the peer p for the providers of the key it knows of, without running a lookup.
+func (dht *IpfsDHT) GetProvidersFromPeer(ctx context.Context, p peer.ID, key multihash.Multihash) (*PeerProvidersResponse, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	}
+
+	pmes, err := dht.findProvidersSingle(ctx, p, key)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerProvidersResponse{
+		Providers:   pb.PBPeersToPeerInfos(pmes.GetProviderPeers()),
+		CloserPeers: pb.PBPeersToPeerInfos(pmes.GetCloserPeers()),
+	}, nil
+}
+
+// PutValueToPeer stores the value for the key at the peer p only, without storing it locally or running a lookup.
+func (dht *IpfsDHT) PutValueToPeer(ctx context.Context, p peer.ID, key string, value []byte) error {
+	if !dht.enableValues {
+		return routing.ErrNotSupported
+	}
+
+	if err := dht.Validator.Validate(key, value); err != nil {
+		return err
+	}
+
+	rec := record.MakePutRecord(key, value)
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	return dht.putValueToPeer(ctx, p, rec)
+}
+
+// ProvideToPeer stores a provider record announcing this node as a provider of the key at the peer p only, without
+// storing it locally or running a lookup.
+func (dht *IpfsDHT) ProvideToPeer(ctx context.Context, p peer.ID, key multihash.Multihash) error {
+	if !dht.enableProviders {
+		return routing.ErrNotSupported
+	}
+
+	mes, err := dht.makeProvRecord(key)
+	if err != nil {
+		return err
+	}
+	return dht.sendMessage(ctx, p, mes)
+}
@@ -0,0 +1,425 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	"github.com/ipfs/go-cid"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// doubleHashSalt salts the second hash of a multihash, that private lookups go by.
+	doubleHashSalt = "CR_DOUBLEHASH"
+	// encryptionKeySalt salts the hash of a multihash the private provider records of the multihash are encrypted
+	// with.
+	encryptionKeySalt = "CR_ENCRYPTIONKEY"
+	// providerTagSalt salts the hash of a multihash and of a provider that tags the private provider records of the
+	// provider for the multihash.
+	providerTagSalt = "CR_PROVIDERTAG"
+	// privateProviderSignaturePrefix separates the signatures of private provider records from the other signatures.
+	privateProviderSignaturePrefix = "dht-private-provider:"
+	// privateProvidersPrefix starts every encoded set of private provider records.
+	privateProvidersPrefix = "/dht-private-providers/1\n"
+	// maxPrivateProviders is the maximum number of private provider records stored for a multihash.
+	maxPrivateProviders = 64
+	// maxPrivateProvidersPerMerge is the maximum number of private provider records a value can add to or replace in
+	// the value it is merged into, so that a single put can't evict the records of every provider.
+	maxPrivateProvidersPerMerge = 4
+	// privateProviderExpirySlack is how far past providers.ProvideValidity the expiry of a private provider record
+	// may be, to allow for clock skew.
+	privateProviderExpirySlack = 10 * time.Minute
+)
+
+var errInvalidPrivateProviders = errors.New("invalid private provider records")
+
+// DoubleHash returns the second hash of the multihash, that private provider lookups go by: peers on the path of a
+// lookup learn the double hash but not the multihash.
+func DoubleHash(mh multihash.Multihash) multihash.Multihash {
+	dh, err := multihash.Sum(append([]byte(doubleHashSalt), mh...), multihash.SHA2_256, -1)
+	if err != nil {
+		// SHA2-256 is always supported
+		panic(err)
+	}
+	return dh
+}
+
+// PrivateProvidersKey returns the key the private provider records of the multihash are stored under, in the
+// "privprov" namespace.
+func PrivateProvidersKey(mh multihash.Multihash) string {
+	return "/privprov/" + string(DoubleHash(mh))
+}
+
+// privateProviderTag returns the tag of the private provider records of the provider for the multihash, that can't
+// be linked to the provider nor to the records of the provider for other multihashes without the multihash.
+func privateProviderTag(mh multihash.Multihash, p peer.ID) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(providerTagSalt)
+	writeLengthPrefixed(&buf, mh)
+	buf.WriteString(string(p))
+	tag := sha256.Sum256(buf.Bytes())
+	return tag[:]
+}
+
+// privateProviderEntry is an encrypted private provider record. Only the expiry and the tag of the provider are in
+// the clear, so that the peers storing the records can drop the expired ones and keep one record per provider.
+type privateProviderEntry struct {
+	expiry     time.Time
+	tag        []byte
+	ciphertext []byte
+}
+
+func marshalPrivateProviders(entries []privateProviderEntry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(privateProvidersPrefix)
+	writeUvarint(&buf, uint64(len(entries)))
+	for _, e := range entries {
+		writeUvarint(&buf, uint64(e.expiry.Unix()))
+		writeLengthPrefixed(&buf, e.tag)
+		writeLengthPrefixed(&buf, e.ciphertext)
+	}
+	return buf.Bytes()
+}
+
+func unmarshalPrivateProviders(data []byte) ([]privateProviderEntry, error) {
+	if !bytes.HasPrefix(data, []byte(privateProvidersPrefix)) {
+		return nil, errInvalidPrivateProviders
+	}
+	r := bytes.NewReader(data[len(privateProvidersPrefix):])
+	n, err := binary.ReadUvarint(r)
+	// every entry takes at least two bytes
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errInvalidPrivateProviders
+	}
+	entries := make([]privateProviderEntry, 0, n)
+	for i := uint64(0); i < n; i++ {
+		expiry, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errInvalidPrivateProviders
+		}
+		tag, ok1 := readLengthPrefixed(r)
+		ciphertext, ok2 := readLengthPrefixed(r)
+		if !ok1 || !ok2 || len(tag) != sha256.Size {
+			return nil, errInvalidPrivateProviders
+		}
+		entries = append(entries, privateProviderEntry{expiry: time.Unix(int64(expiry), 0), tag: tag, ciphertext: ciphertext})
+	}
+	if r.Len() != 0 {
+		return nil, errInvalidPrivateProviders
+	}
+	return entries, nil
+}
+
+// PrivateProvidersValidator is the MergingValidator of the "privprov" namespace. The peers storing private provider
+// records can't decrypt them: they only check that the records are well formed, and merge the records of the
+// different providers, keeping the latest record of every provider and dropping the expired ones.
+type PrivateProvidersValidator struct{}
+
+var _ MergingValidator = PrivateProvidersValidator{}
+
+// Validate checks that the value is a well formed set of at most 64 private provider records, that don't expire
+// after providers.ProvideValidity.
+func (PrivateProvidersValidator) Validate(_ string, value []byte) error {
+	entries, err := unmarshalPrivateProviders(value)
+	if err != nil {
+		return err
+	}
+	if len(entries) > maxPrivateProviders {
+		return fmt.Errorf("%d private provider records, more than the maximum of %d", len(entries), maxPrivateProviders)
+	}
+	maxExpiry := time.Now().Add(providers.ProvideValidity + privateProviderExpirySlack)
+	for _, e := range entries {
+		if e.expiry.After(maxExpiry) {
+			return fmt.Errorf("private provider record expiring at %s, after the maximum validity", e.expiry)
+		}
+	}
+	return nil
+}
+
+// Select selects the value with the most records, it is only used when values can't be merged.
+func (PrivateProvidersValidator) Select(_ string, values [][]byte) (int, error) {
+	best, bestLen := -1, -1
+	for i, val := range values {
+		entries, err := unmarshalPrivateProviders(val)
+		if err != nil {
+			continue
+		}
+		if len(entries) > bestLen {
+			best, bestLen = i, len(entries)
+		}
+	}
+	if best == -1 {
+		return 0, errInvalidPrivateProviders
+	}
+	return best, nil
+}
+
+// Merge returns the latest record of every provider among the records that didn't expire. Every value after the first
+// one adds or replaces at most 4 records. Once the union is full, the records expiring first are evicted, the records
+// of the first value winning ties.
+func (PrivateProvidersValidator) Merge(_ string, values [][]byte) ([]byte, error) {
+	now := time.Now()
+	var merged []privateProviderEntry
+	byTag := make(map[string]int)
+	for v, val := range values {
+		entries, err := unmarshalPrivateProviders(val)
+		if err != nil {
+			return nil, err
+		}
+		changed := 0
+		for _, e := range entries {
+			if now.After(e.expiry) {
+				continue
+			}
+			i, ok := byTag[string(e.tag)]
+			if ok && !e.expiry.After(merged[i].expiry) {
+				continue
+			}
+			if v > 0 {
+				if changed == maxPrivateProvidersPerMerge {
+					continue
+				}
+				changed++
+			}
+			if ok {
+				merged[i] = e
+				continue
+			}
+			byTag[string(e.tag)] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].expiry.After(merged[j].expiry) })
+	if len(merged) > maxPrivateProviders {
+		merged = merged[:maxPrivateProviders]
+	}
+	return marshalPrivateProviders(merged), nil
+}
+
+// privateProvidersCipher returns the cipher the private provider records of the multihash are encrypted with.
+func privateProvidersCipher(mh multihash.Multihash) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte(encryptionKeySalt), mh...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// privateProviderSignedBytes returns the bytes the provider signs in a private provider record.
+func privateProviderSignedBytes(dh multihash.Multihash, expiry time.Time, p peer.ID, addrs [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(privateProviderSignaturePrefix)
+	writeLengthPrefixed(&buf, dh)
+	writeUvarint(&buf, uint64(expiry.Unix()))
+	writeLengthPrefixed(&buf, []byte(p))
+	for _, a := range addrs {
+		writeLengthPrefixed(&buf, a)
+	}
+	return buf.Bytes()
+}
+
+// privateProviderAD returns the data authenticated along a private provider record, so that the record can't be moved
+// to another key, extended or tagged as another provider's.
+func privateProviderAD(dh multihash.Multihash, expiry time.Time, tag []byte) []byte {
+	ad := privateProviderSignedBytes(dh, expiry, "", nil)
+	return append(ad, tag...)
+}
+
+// sealPrivateProvider encrypts the signed provider record of this node for the multihash.
+func (dht *IpfsDHT) sealPrivateProvider(mh multihash.Multihash, expiry time.Time) (privateProviderEntry, error) {
+	sk := dht.peerstore.PrivKey(dht.self)
+	if sk == nil {
+		return privateProviderEntry{}, errors.New("no private key for this node in the peerstore")
+	}
+	pkbytes, err := ci.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return privateProviderEntry{}, err
+	}
+	var addrs [][]byte
+	for _, a := range dht.host.Addrs() {
+		addrs = append(addrs, a.Bytes())
+	}
+	dh := DoubleHash(mh)
+	sig, err := sk.Sign(privateProviderSignedBytes(dh, expiry, dht.self, addrs))
+	if err != nil {
+		return privateProviderEntry{}, err
+	}
+
+	var plaintext bytes.Buffer
+	writeLengthPrefixed(&plaintext, []byte(dht.self))
+	writeLengthPrefixed(&plaintext, pkbytes)
+	writeLengthPrefixed(&plaintext, sig)
+	writeUvarint(&plaintext, uint64(len(addrs)))
+	for _, a := range addrs {
+		writeLengthPrefixed(&plaintext, a)
+	}
+
+	aead, err := privateProvidersCipher(mh)
+	if err != nil {
+		return privateProviderEntry{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return privateProviderEntry{}, err
+	}
+	tag := privateProviderTag(mh, dht.self)
+	return privateProviderEntry{
+		expiry:     expiry,
+		tag:        tag,
+		ciphertext: aead.Seal(nonce, nonce, plaintext.Bytes(), privateProviderAD(dh, expiry, tag)),
+	}, nil
+}
+
+// openPrivateProvider decrypts a private provider record of the multihash and checks the signature of the provider.
+func openPrivateProvider(aead cipher.AEAD, mh multihash.Multihash, e privateProviderEntry) (peer.AddrInfo, error) {
+	if len(e.ciphertext) < aead.NonceSize() {
+		return peer.AddrInfo{}, errInvalidPrivateProviders
+	}
+	dh := DoubleHash(mh)
+	nonce, ciphertext := e.ciphertext[:aead.NonceSize()], e.ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, privateProviderAD(dh, e.expiry, e.tag))
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	r := bytes.NewReader(plaintext)
+	idbytes, ok1 := readLengthPrefixed(r)
+	pkbytes, ok2 := readLengthPrefixed(r)
+	sig, ok3 := readLengthPrefixed(r)
+	n, err := binary.ReadUvarint(r)
+	if !ok1 || !ok2 || !ok3 || err != nil || n > uint64(r.Len()) {
+		return peer.AddrInfo{}, errInvalidPrivateProviders
+	}
+	addrs := make([][]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		a, ok := readLengthPrefixed(r)
+		if !ok {
+			return peer.AddrInfo{}, errInvalidPrivateProviders
+		}
+		addrs = append(addrs, a)
+	}
+
+	p, err := peer.IDFromBytes(idbytes)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	pk, err := ci.UnmarshalPublicKey(pkbytes)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+	if !p.MatchesPublicKey(pk) {
+		return peer.AddrInfo{}, errors.New("private provider record public key doesn't match the provider")
+	}
+	if !bytes.Equal(e.tag, privateProviderTag(mh, p)) {
+		return peer.AddrInfo{}, errors.New("private provider record tag doesn't match the provider")
+	}
+	if ok, err := pk.Verify(privateProviderSignedBytes(dh, e.expiry, p, addrs), sig); err != nil || !ok {
+		return peer.AddrInfo{}, errors.New("invalid private provider record signature")
+	}
+
+	ai := peer.AddrInfo{ID: p}
+	for _, a := range addrs {
+		maddr, err := ma.NewMultiaddrBytes(a)
+		if err != nil {
+			continue
+		}
+		ai.Addrs = append(ai.Addrs, maddr)
+	}
+	return ai, nil
+}
+
+// privateProvidersEnabled returns true if the DHT validates private provider records, e.g. with
+// EnablePrivateProviders.
+func (dht *IpfsDHT) privateProvidersEnabled() bool {
+	_, ok := dht.mergingValidator(PrivateProvidersKey(nil)).(PrivateProvidersValidator)
+	return ok
+}
+
+// ProvidePrivate announces that this node can provide the value of the key, like Provide but without revealing the
+// key: the provider record is encrypted with a key derived from the multihash of the key, and stored under the double
+// hash of the multihash (see PrivateProvidersKey) with PutValue. Only the nodes that know the key can find the
+// provider with FindProvidersPrivate.
+//
+// The records live alongside the regular provider records, in the "privprov" namespace of the values, which the DHT
+// only validates with EnablePrivateProviders: it returns routing.ErrNotSupported otherwise. They are valid for
+// providers.ProvideValidity.
+//
+// The peers storing the records can't tell real records from junk: they keep at most 64 records per key, the ones
+// expiring last, and a put adds or replaces at most 4 of them. A peer sending many puts can still flood the records
+// of a key with junk until the real records are provided again.
+func (dht *IpfsDHT) ProvidePrivate(ctx context.Context, key cid.Cid, opts ...routing.Option) error {
+	if !dht.enableValues || !dht.privateProvidersEnabled() {
+		return routing.ErrNotSupported
+	} else if !key.Defined() {
+		return fmt.Errorf("invalid cid: undefined")
+	}
+
+	e, err := dht.sealPrivateProvider(key.Hash(), time.Now().Add(providers.ProvideValidity))
+	if err != nil {
+		return err
+	}
+	return dht.PutValue(ctx, PrivateProvidersKey(key.Hash()), marshalPrivateProviders([]privateProviderEntry{e}), opts...)
+}
+
+// FindProvidersPrivate searches for the providers of the key announced with ProvidePrivate. The lookup goes by the
+// double hash of the multihash of the key, so that the peers on its path don't learn the key.
+func (dht *IpfsDHT) FindProvidersPrivate(ctx context.Context, key cid.Cid, opts ...routing.Option) ([]peer.AddrInfo, error) {
+	if !dht.enableValues || !dht.privateProvidersEnabled() {
+		return nil, routing.ErrNotSupported
+	} else if !key.Defined() {
+		return nil, fmt.Errorf("invalid cid: undefined")
+	}
+
+	mh := key.Hash()
+	data, err := dht.GetValue(ctx, PrivateProvidersKey(mh), opts...)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := unmarshalPrivateProviders(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := privateProvidersCipher(mh)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var provs []peer.AddrInfo
+	seen := make(map[peer.ID]struct{})
+	for _, e := range entries {
+		if now.After(e.expiry) {
+			continue
+		}
+		ai, err := openPrivateProvider(aead, mh, e)
+		if err != nil {
+			logger.Debugw("invalid private provider record", "error", err)
+			continue
+		}
+		if _, ok := seen[ai.ID]; ok {
+			continue
+		}
+		seen[ai.ID] = struct{}{}
+		provs = append(provs, ai)
+	}
+	if len(provs) == 0 {
+		return nil, routing.ErrNotFound
+	}
+	return provs, nil
+}
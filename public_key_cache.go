@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+const (
+	// defaultPublicKeyNegativeTTL is the default time failures to fetch a public key are remembered for.
+	defaultPublicKeyNegativeTTL = time.Minute
+	// defaultPublicKeyFetchConcurrency is the default number of public keys fetched from the network at the same time.
+	defaultPublicKeyFetchConcurrency = 32
+	// maxPublicKeyFailures is the maximum number of failed fetches remembered, the ones expiring first are evicted
+	// beyond that.
+	maxPublicKeyFailures = 10000
+)
+
+// publicKeyCache deduplicates the concurrent fetches of the public key of a peer and remembers the failed ones. The
+// keys found are kept in the peerstore.
+type publicKeyCache struct {
+	negativeTTL time.Duration
+	// slots bounds the number of fetches running at the same time.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	failures map[peer.ID]*list.Element
+	// failureOrder holds the *publicKeyFailure values by expiry, soonest first: all the failures have the same ttl.
+	failureOrder *list.List
+	inflight     map[peer.ID]*publicKeyFetch
+}
+
+type publicKeyFailure struct {
+	p       peer.ID
+	err     error
+	expires time.Time
+}
+
+// publicKeyFetch is a fetch of the public key of a peer, shared by the callers waiting for it.
+type publicKeyFetch struct {
+	cancel context.CancelFunc
+	// done is closed once pk and err are set.
+	done    chan struct{}
+	pk      ci.PubKey
+	err     error
+	waiters int
+}
+
+func newPublicKeyCache(negativeTTL time.Duration, concurrency int) *publicKeyCache {
+	return &publicKeyCache{
+		negativeTTL:  negativeTTL,
+		slots:        make(chan struct{}, concurrency),
+		failures:     make(map[peer.ID]*list.Element),
+		failureOrder: list.New(),
+		inflight:     make(map[peer.ID]*publicKeyFetch),
+	}
+}
+
+// get returns the public key of the peer, fetching it with fetch unless a recent fetch failed or one is running
+// already. The fetch runs in the given context, and is cancelled once all the callers waiting for it gave up.
+func (c *publicKeyCache) get(ctx, fetchCtx context.Context, p peer.ID, fetch func(context.Context, peer.ID) (ci.PubKey, error)) (ci.PubKey, error) {
+	c.mu.Lock()
+	if e, ok := c.failures[p]; ok {
+		f := e.Value.(*publicKeyFailure)
+		if time.Now().Before(f.expires) {
+			c.mu.Unlock()
+			return nil, f.err
+		}
+		c.removeFailureLocked(e)
+	}
+
+	f, ok := c.inflight[p]
+	if !ok {
+		fetchCtx, cancel := context.WithCancel(fetchCtx)
+		f = &publicKeyFetch{cancel: cancel, done: make(chan struct{})}
+		c.inflight[p] = f
+		go func() {
+			defer cancel()
+			pk, err := fetch(fetchCtx, p)
+
+			c.mu.Lock()
+			f.pk, f.err = pk, err
+			if c.inflight[p] == f {
+				delete(c.inflight, p)
+			}
+			// don't remember fetches that were cancelled
+			if err != nil && c.negativeTTL > 0 && fetchCtx.Err() == nil {
+				c.addFailureLocked(p, err)
+			}
+			c.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.pk, f.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if c.inflight[p] == f {
+				delete(c.inflight, p)
+			}
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *publicKeyCache) addFailureLocked(p peer.ID, err error) {
+	if e, ok := c.failures[p]; ok {
+		c.removeFailureLocked(e)
+	}
+	c.failures[p] = c.failureOrder.PushBack(&publicKeyFailure{p: p, err: err, expires: time.Now().Add(c.negativeTTL)})
+	for len(c.failures) > maxPublicKeyFailures {
+		c.removeFailureLocked(c.failureOrder.Front())
+	}
+}
+
+func (c *publicKeyCache) removeFailureLocked(e *list.Element) {
+	delete(c.failures, e.Value.(*publicKeyFailure).p)
+	c.failureOrder.Remove(e)
+}
+
+// sweep drops the expired failures.
+func (c *publicKeyCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for e := c.failureOrder.Front(); e != nil && now.After(e.Value.(*publicKeyFailure).expires); e = c.failureOrder.Front() {
+		c.removeFailureLocked(e)
+	}
+}
+
+// sweepPublicKeyFailures periodically drops the expired failures of the public key cache.
+func (dht *IpfsDHT) sweepPublicKeyFailures(proc goprocess.Process) {
+	ticker := time.NewTicker(dht.publicKeys.negativeTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dht.publicKeys.sweep()
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// acquire waits for a fetch slot, that must be released once the fetch is done.
+func (c *publicKeyCache) acquire(ctx context.Context) error {
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *publicKeyCache) release() {
+	<-c.slots
+}
+
+// PublicKeyResult is the result of fetching the public key of a peer with GetPublicKeys.
+type PublicKeyResult struct {
+	Peer peer.ID
+	// Key is nil if the key couldn't be fetched.
+	Key ci.PubKey
+	Err error
+}
+
+// GetPublicKeys gets the public keys of many peers concurrently, like GetPublicKey. The number of keys fetched from
+// the network at the same time is bounded across all calls (see PublicKeyFetchConcurrency). The results are in the
+// order of the peers.
+func (dht *IpfsDHT) GetPublicKeys(ctx context.Context, peers []peer.ID) []PublicKeyResult {
+	results := make([]PublicKeyResult, len(peers))
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		results[i].Peer = p
+		wg.Add(1)
+		go func(res *PublicKeyResult) {
+			defer wg.Done()
+			res.Key, res.Err = dht.GetPublicKey(ctx, res.Peer)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
@@ -20,6 +20,9 @@ const (
 	PeerQueried
 	// PeerUnreachable is applied to peers who have been queried and a response was not retrieved successfully.
 	PeerUnreachable
+	// PeerSlow is applied to peers that are being queried, but haven't responded within the time they usually take.
+	// The lookup goes on without waiting for them, unless they respond in time to be useful.
+	PeerSlow
 )
 
 // QueryPeerset maintains the state of a Kademlia asynchronous lookup.
@@ -157,3 +160,18 @@ func (qp *QueryPeerset) NumHeard() int {
 func (qp *QueryPeerset) NumWaiting() int {
 	return len(qp.GetClosestInStates(PeerWaiting))
 }
+
+// NumQueried returns the number of peers in state PeerQueried.
+func (qp *QueryPeerset) NumQueried() int {
+	return len(qp.GetClosestInStates(PeerQueried))
+}
+
+// NumUnreachable returns the number of peers in state PeerUnreachable.
+func (qp *QueryPeerset) NumUnreachable() int {
+	return len(qp.GetClosestInStates(PeerUnreachable))
+}
+
+// NumSlow returns the number of peers in state PeerSlow.
+func (qp *QueryPeerset) NumSlow() int {
+	return len(qp.GetClosestInStates(PeerSlow))
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
@@ -20,8 +21,10 @@ import (
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
+	"go.opencensus.io/stats"
 )
 
 // ErrNoPeersQueried is returned when we failed to connect to any peers.
@@ -30,11 +33,153 @@ var ErrNoPeersQueried = errors.New("failed to query any peers")
 type queryFn func(context.Context, peer.ID) ([]*peer.AddrInfo, error)
 type stopFn func() bool
 
+// lookupParams are the parameters of a single lookup. They default to the DHT's configuration and can be overridden
+// for a single call with routing options, either passed to the call or attached to its context with
+// WithRoutingOptions.
+type lookupParams struct {
+	// disjointPaths is the number of disjoint paths the lookup is split into.
+	disjointPaths int
+	// alpha is the concurrency per path.
+	alpha int
+	// beta is the number of peers closest to the target that must have responded for a path to terminate.
+	beta int
+	// resultSize is the number of closest peers the lookup returns.
+	resultSize int
+	// seedPeers, if not empty, are the peers the lookup starts from instead of the closest peers in the routing table.
+	seedPeers []peer.AddrInfo
+
+	budget *lookupBudget
+
+	// handle, if not nil, follows the progress of the lookup.
+	handle *Lookup
+}
+
+func (dht *IpfsDHT) lookupParams(ctx context.Context, opts ...routing.Option) (*lookupParams, error) {
+	var cfg routing.Options
+	if err := cfg.Apply(routingOptionsFromContext(ctx)...); err != nil {
+		return nil, err
+	}
+	if err := cfg.Apply(opts...); err != nil {
+		return nil, err
+	}
+	return &lookupParams{
+		disjointPaths: getDisjointPaths(&cfg, dht.disjointPaths),
+		alpha:         getLookupConcurrency(&cfg, dht.alpha),
+		beta:          getLookupResiliency(&cfg, dht.beta),
+		resultSize:    getLookupResultSize(&cfg, dht.bucketSize),
+		seedPeers:     getLookupSeedPeers(&cfg),
+		budget:        newLookupBudget(&cfg),
+	}, nil
+}
+
+func newLookupBudget(cfg *routing.Options) *lookupBudget {
+	b := &lookupBudget{
+		maxPeers: getLookupMaxPeers(cfg, 0),
+		maxRPCs:  getLookupMaxRPCs(cfg, 0),
+		maxHops:  getLookupMaxHops(cfg, 0),
+	}
+	if d := getLookupMaxDuration(cfg, 0); d > 0 {
+		b.deadline = time.Now().Add(d)
+	}
+	return b
+}
+
+// lookupBudget limits the resources a lookup uses. It is shared by all paths of the lookup and its follow-up.
+// A lookup that exhausts its budget terminates with LookupBudgetExhausted and returns the closest peers found so far.
+type lookupBudget struct {
+	// maxPeers is the maximum number of peers the lookup contacts, 0 for no limit.
+	maxPeers  int
+	contacted int32 // accessed atomically
+	// maxRPCs is the maximum number of queries the lookup sends, including the follow-up, 0 for no limit.
+	maxRPCs int
+	rpcs    int32 // accessed atomically
+	// maxHops is the maximum number of referrals between us and a peer the lookup queries, 0 for no limit. The
+	// closest peers in our routing table are one hop away.
+	maxHops int
+	// deadline is the time at which the lookup stops, zero for no limit.
+	deadline time.Time
+}
+
+// tryQuery reserves the budget to send a query. newPeer tells whether the query contacts a peer the lookup hasn't
+// contacted yet. It returns false if the budget is exhausted.
+func (b *lookupBudget) tryQuery(newPeer bool) bool {
+	if b.expired() || !reserve(&b.rpcs, b.maxRPCs) {
+		return false
+	}
+	if newPeer && !reserve(&b.contacted, b.maxPeers) {
+		atomic.AddInt32(&b.rpcs, -1)
+		return false
+	}
+	return true
+}
+
+// exhausted returns true if the lookup can't send any more queries.
+func (b *lookupBudget) exhausted() bool {
+	return b.expired() || used(&b.rpcs, b.maxRPCs) || used(&b.contacted, b.maxPeers)
+}
+
+// expired returns true if the lookup ran out of time.
+func (b *lookupBudget) expired() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+// reserve increments the counter unless it reached max, 0 meaning no limit.
+func reserve(counter *int32, max int) bool {
+	if max == 0 {
+		return true
+	}
+	if atomic.AddInt32(counter, 1) > int32(max) {
+		atomic.AddInt32(counter, -1)
+		return false
+	}
+	return true
+}
+
+func used(counter *int32, max int) bool {
+	return max != 0 && atomic.LoadInt32(counter) >= int32(max)
+}
+
+// disjointPathClaims records which of the disjoint paths of a lookup each peer belongs to, making sure no peer is
+// used by more than one path.
+type disjointPathClaims struct {
+	mu     sync.Mutex
+	owners map[peer.ID]int
+}
+
+func newDisjointPathClaims() *disjointPathClaims {
+	return &disjointPathClaims{owners: make(map[peer.ID]int)}
+}
+
+// claim assigns the peer p to the given path, unless it already belongs to another path. It returns true if p
+// belongs to the path. A nil *disjointPathClaims lets every path use every peer.
+func (c *disjointPathClaims) claim(p peer.ID, path int) bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.owners[p]; ok {
+		return owner == path
+	}
+	c.owners[p] = path
+	return true
+}
+
 // query represents a single DHT query.
+// A lookup using disjoint paths runs one query per path.
 type query struct {
 	// unique identifier for the lookup instance
 	id uuid.UUID
 
+	// path is the index of the disjoint path this query runs for the lookup.
+	path int
+
+	// claims makes sure the disjoint paths of the lookup don't share peers. It is nil if the lookup has a single path.
+	claims *disjointPathClaims
+
+	// params are the parameters of the lookup.
+	params *lookupParams
+
 	// target key for the lookup
 	key string
 
@@ -49,12 +194,20 @@ type query struct {
 	// peerTimes contains the duration of each successful query to a peer
 	peerTimes map[peer.ID]time.Duration
 
+	// peerHops contains the number of referrals between us and each peer in queryPeers
+	peerHops map[peer.ID]int
+
+	// mu protects queryPeers and reason, which lookup handles read while the query runs.
+	mu sync.Mutex
+
 	// queryPeers is the set of peers known by this query and their respective states.
 	queryPeers *qpeerset.QueryPeerset
 
 	// terminated is set when the first worker thread encounters the termination condition.
 	// Its role is to make sure that once termination is determined, it is sticky.
 	terminated bool
+	// reason is the reason the query terminated for, once it's terminated.
+	reason LookupTerminationReason
 
 	// waitGroup ensures lookup does not end until all query goroutines complete.
 	waitGroup sync.WaitGroup
@@ -69,10 +222,25 @@ type query struct {
 type lookupWithFollowupResult struct {
 	peers []peer.ID            // the top K not unreachable peers at the end of the query
 	state []qpeerset.PeerState // the peer states at the end of the query
+	rtt   []time.Duration      // the durations of the queries to the peers, 0 for peers the query didn't query
 
 	// indicates that neither the lookup nor the followup has been prematurely terminated by an external condition such
 	// as context cancellation or the stop function being called.
 	completed bool
+	// the reason the lookup terminated for, or the reason the followup was interrupted for.
+	reason LookupTerminationReason
+
+	// repaired is set once read-repair ran for the result, which callers sharing the lookup all get.
+	repaired int32
+}
+
+// interrupt marks the result as not completed because the followup was interrupted for the given reason, unless the
+// lookup itself had not completed.
+func (r *lookupWithFollowupResult) interrupt(reason LookupTerminationReason) {
+	if r.completed {
+		r.reason = reason
+	}
+	r.completed = false
 }
 
 // runLookupWithFollowup executes the lookup on the target using the given query function and stopping when either the
@@ -82,20 +250,39 @@ type lookupWithFollowupResult struct {
 //
 // After the lookup is complete the query function is run (unless stopped) against all of the top K peers from the
 // lookup that have not already been successfully queried.
-func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+//
+// The routing options, if any, override the lookup parameters for this lookup (see lookupParams).
+func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, queryFn queryFn, stopFn stopFn, opts ...routing.Option) (*lookupWithFollowupResult, error) {
+	params, err := dht.lookupParams(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return dht.runLookupWithFollowupParams(ctx, target, queryFn, stopFn, params)
+}
+
+func (dht *IpfsDHT) runLookupWithFollowupParams(ctx context.Context, target string, queryFn queryFn, stopFn stopFn, params *lookupParams) (*lookupWithFollowupResult, error) {
 	// run the query
-	lookupRes, err := dht.runQuery(ctx, target, queryFn, stopFn)
+	lookupRes, err := dht.runQueryWithParams(ctx, target, queryFn, stopFn, params)
 	if err != nil {
 		return nil, err
 	}
+	// the cache seeds the regular lookups, don't fill it with the results of lookups that didn't start from the
+	// routing table or that were split into disjoint paths
+	if len(params.seedPeers) == 0 && params.disjointPaths <= 1 {
+		defer dht.cacheClosestPeers(target, lookupRes)
+	}
 
-	// query all of the top K peers we've either Heard about or have outstanding queries we're Waiting on.
+	// query all of the top K peers we've either Heard about or have outstanding (possibly Slow) queries we're Waiting on.
 	// This ensures that all of the top K results have been queried which adds to resiliency against churn for query
 	// functions that carry state (e.g. FindProviders and GetValue) as well as establish connections that are needed
 	// by stateless query functions (e.g. GetClosestPeers and therefore Provide and PutValue)
 	queryPeers := make([]peer.ID, 0, len(lookupRes.peers))
 	for i, p := range lookupRes.peers {
-		if state := lookupRes.state[i]; state == qpeerset.PeerHeard || state == qpeerset.PeerWaiting {
+		if state := lookupRes.state[i]; state == qpeerset.PeerHeard || state == qpeerset.PeerWaiting || state == qpeerset.PeerSlow {
+			if !params.budget.tryQuery(state == qpeerset.PeerHeard) {
+				lookupRes.interrupt(LookupBudgetExhausted)
+				break
+			}
 			queryPeers = append(queryPeers, p)
 		}
 	}
@@ -105,14 +292,22 @@ func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, qu
 	}
 
 	// return if the lookup has been externally stopped
-	if ctx.Err() != nil || stopFn() {
-		lookupRes.completed = false
+	if ctx.Err() != nil {
+		lookupRes.interrupt(LookupCancelled)
+		return lookupRes, nil
+	}
+	if stopFn() {
+		lookupRes.interrupt(LookupStopped)
 		return lookupRes, nil
 	}
 
 	doneCh := make(chan struct{}, len(queryPeers))
 	followUpCtx, cancelFollowUp := context.WithCancel(ctx)
 	defer cancelFollowUp()
+	if deadline := params.budget.deadline; !deadline.IsZero() {
+		followUpCtx, cancelFollowUp = context.WithDeadline(followUpCtx, deadline)
+		defer cancelFollowUp()
+	}
 	for _, p := range queryPeers {
 		qp := p
 		go func() {
@@ -131,16 +326,20 @@ processFollowUp:
 			if stopFn() {
 				cancelFollowUp()
 				if i < len(queryPeers)-1 {
-					lookupRes.completed = false
+					lookupRes.interrupt(LookupStopped)
 				}
 				break processFollowUp
 			}
 		case <-ctx.Done():
-			lookupRes.completed = false
+			lookupRes.interrupt(LookupCancelled)
 			cancelFollowUp()
 			break processFollowUp
 		}
 	}
+	if followUpCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// the followup ran out of time
+		lookupRes.interrupt(LookupBudgetExhausted)
+	}
 
 	if !lookupRes.completed {
 		for i := followupsCompleted; i < len(queryPeers); i++ {
@@ -151,10 +350,41 @@ processFollowUp:
 	return lookupRes, nil
 }
 
-func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
-	// pick the K closest peers to the key in our Routing table.
+// seedPeers returns the IDs of the given seed peers, except ourselves, sorted by distance to the target, after
+// adding their addresses to the peerstore.
+func (dht *IpfsDHT) seedPeers(seeds []peer.AddrInfo, target kb.ID) []peer.ID {
+	ids := make([]peer.ID, 0, len(seeds))
+	seen := make(map[peer.ID]struct{}, len(seeds))
+	for _, ai := range seeds {
+		if _, ok := seen[ai.ID]; ok || ai.ID == dht.self {
+			continue
+		}
+		seen[ai.ID] = struct{}{}
+		dht.maybeAddAddrs(ai.ID, ai.Addrs, pstore.TempAddrTTL)
+		ids = append(ids, ai.ID)
+	}
+	return dht.routingTable.SortClosestPeers(ids, target)
+}
+
+// runQuery executes the lookup on the target without the follow-up of runLookupWithFollowup.
+func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn, stopFn stopFn, opts ...routing.Option) (*lookupWithFollowupResult, error) {
+	params, err := dht.lookupParams(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return dht.runQueryWithParams(ctx, target, queryFn, stopFn, params)
+}
+
+func (dht *IpfsDHT) runQueryWithParams(ctx context.Context, target string, queryFn queryFn, stopFn stopFn, params *lookupParams) (*lookupWithFollowupResult, error) {
+	// pick the K closest peers to the key in our Routing table (and closest peers cache), unless we've been given the
+	// peers to start from.
 	targetKadID := kb.ConvertKey(target)
-	seedPeers := dht.routingTable.NearestPeers(targetKadID, dht.bucketSize)
+	var seedPeers []peer.ID
+	if len(params.seedPeers) > 0 {
+		seedPeers = dht.seedPeers(params.seedPeers, targetKadID)
+	} else {
+		seedPeers = dht.nearestSeedPeers(targetKadID)
+	}
 	if len(seedPeers) == 0 {
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
@@ -163,30 +393,86 @@ func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn
 		return nil, kb.ErrLookupFailure
 	}
 
-	q := &query{
-		id:         uuid.New(),
-		key:        target,
-		ctx:        ctx,
-		dht:        dht,
-		queryPeers: qpeerset.NewQueryPeerset(target),
-		seedPeers:  seedPeers,
-		peerTimes:  make(map[peer.ID]time.Duration),
-		terminated: false,
-		queryFn:    queryFn,
-		stopFn:     stopFn,
+	// S/Kademlia: split the lookup into disjoint paths that don't share any peers, so that an adversary has to
+	// control a peer on every path to eclipse the lookup.
+	nPaths := params.disjointPaths
+	if nPaths > len(seedPeers) {
+		nPaths = len(seedPeers)
+	}
+	var claims *disjointPathClaims
+	if nPaths > 1 {
+		claims = newDisjointPathClaims()
+	}
+
+	id := uuid.New()
+	paths := make([]*query, nPaths)
+	for i := range paths {
+		paths[i] = &query{
+			id:         id,
+			path:       i,
+			claims:     claims,
+			params:     params,
+			key:        target,
+			ctx:        ctx,
+			dht:        dht,
+			queryPeers: qpeerset.NewQueryPeerset(target),
+			peerTimes:  make(map[peer.ID]time.Duration),
+			peerHops:   make(map[peer.ID]int),
+			terminated: false,
+			queryFn:    queryFn,
+			stopFn:     stopFn,
+		}
+	}
+	if params.handle != nil {
+		params.handle.setPaths(paths)
+	}
+
+	// deal the seed peers out to the paths, so that every path starts with some of the closest peers we know.
+	for i, p := range seedPeers {
+		q := paths[i%nPaths]
+		q.seedPeers = append(q.seedPeers, p)
+		claims.claim(p, q.path)
 	}
 
 	// run the query
-	q.run()
+	if len(paths) == 1 {
+		paths[0].run()
+	} else {
+		var wg sync.WaitGroup
+		for _, q := range paths {
+			wg.Add(1)
+			go func(q *query) {
+				defer wg.Done()
+				q.run()
+			}(q)
+		}
+		wg.Wait()
+	}
 
 	if ctx.Err() == nil {
-		q.recordValuablePeers()
+		for _, q := range paths {
+			q.recordValuablePeers()
+		}
 	}
 
-	res := q.constructLookupResult(targetKadID)
+	res := dht.constructLookupResult(paths, targetKadID, params.resultSize)
+	if res.completed {
+		dht.trackNetworkSize(target, res.peers)
+	}
 	return res, nil
 }
 
+// trackNetworkSize feeds the closest peers found by a completed lookup to the network size estimator.
+func (dht *IpfsDHT) trackNetworkSize(target string, peers []peer.ID) {
+	if err := dht.nsEstimator.Track(target, peers); err != nil {
+		// small networks don't have K peers to track.
+		return
+	}
+	if size, err := dht.nsEstimator.NetworkSize(); err == nil {
+		stats.Record(dht.ctx, metrics.NetworkSize.M(int64(size)))
+	}
+}
+
 func (q *query) recordPeerIsValuable(p peer.ID) {
 	if !q.dht.routingTable.UpdateLastUsefulAt(p, time.Now()) {
 		// not in routing table
@@ -213,43 +499,59 @@ func (q *query) recordValuablePeers() {
 	}
 }
 
-// constructLookupResult takes the query information and uses it to construct the lookup result
-func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
+// constructLookupResult takes the information of the queries of all paths of a lookup and uses it to construct the
+// lookup result, made of the n closest peers
+func (dht *IpfsDHT) constructLookupResult(paths []*query, target kb.ID, n int) *lookupWithFollowupResult {
 	// determine if the query terminated early
 	completed := true
+	reason := LookupCompleted
 
-	// Lookup and starvation are both valid ways for a lookup to complete. (Starvation does not imply failure.)
-	// Lookup termination (as defined in isLookupTermination) is not possible in small networks.
-	// Starvation is a successful query termination in small networks.
-	if !(q.isLookupTermination() || q.isStarvationTermination()) {
-		completed = false
-	}
-
-	// extract the top K not unreachable peers
+	// extract the top n not unreachable peers of every path
 	var peers []peer.ID
 	peerState := make(map[peer.ID]qpeerset.PeerState)
-	qp := q.queryPeers.GetClosestNInStates(q.dht.bucketSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
-	for _, p := range qp {
-		state := q.queryPeers.GetState(p)
-		peerState[p] = state
-		peers = append(peers, p)
+	peerTimes := make(map[peer.ID]time.Duration)
+	for _, q := range paths {
+		q.mu.Lock()
+		// Lookup and starvation are both valid ways for a lookup to complete. (Starvation does not imply failure.)
+		// Lookup termination (as defined in isLookupTermination) is not possible in small networks.
+		// Starvation is a successful query termination in small networks.
+		if !(q.isLookupTermination() || q.isStarvationTermination()) {
+			if completed {
+				reason = q.reason
+			}
+			completed = false
+		} else if completed && q.reason == LookupStarvation {
+			reason = LookupStarvation
+		}
+
+		qp := q.queryPeers.GetClosestNInStates(n, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerSlow, qpeerset.PeerQueried)
+		for _, p := range qp {
+			state := q.queryPeers.GetState(p)
+			peerState[p] = state
+			peerTimes[p] = q.peerTimes[p]
+			peers = append(peers, p)
+		}
+		q.mu.Unlock()
 	}
 
-	// get the top K overall peers
-	sortedPeers := q.dht.routingTable.SortClosestPeers(peers, target)
-	if len(sortedPeers) > q.dht.bucketSize {
-		sortedPeers = sortedPeers[:q.dht.bucketSize]
+	// get the top n overall peers
+	sortedPeers := dht.routingTable.SortClosestPeers(peers, target)
+	if len(sortedPeers) > n {
+		sortedPeers = sortedPeers[:n]
 	}
 
-	// return the top K not unreachable peers as well as their states at the end of the query
+	// return the top n not unreachable peers as well as their states at the end of the query
 	res := &lookupWithFollowupResult{
 		peers:     sortedPeers,
 		state:     make([]qpeerset.PeerState, len(sortedPeers)),
+		rtt:       make([]time.Duration, len(sortedPeers)),
 		completed: completed,
+		reason:    reason,
 	}
 
 	for i, p := range sortedPeers {
 		res.state[i] = peerState[p]
+		res.rtt[i] = peerTimes[p]
 	}
 
 	return res
@@ -260,6 +562,7 @@ type queryUpdate struct {
 	queried     []peer.ID
 	heard       []peer.ID
 	unreachable []peer.ID
+	slow        []peer.ID
 
 	queryDuration time.Duration
 }
@@ -268,11 +571,19 @@ func (q *query) run() {
 	pathCtx, cancelPath := context.WithCancel(q.ctx)
 	defer cancelPath()
 
-	alpha := q.dht.alpha
+	alpha := q.params.alpha
 
 	ch := make(chan *queryUpdate, alpha)
 	ch <- &queryUpdate{cause: q.dht.self, heard: q.seedPeers}
 
+	// wake up when the lookup runs out of time
+	var deadline <-chan time.Time
+	if d := q.params.budget.deadline; !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
 	// return only once all outstanding queries have completed.
 	defer q.waitGroup.Wait()
 	for {
@@ -281,17 +592,24 @@ func (q *query) run() {
 		case update := <-ch:
 			q.updateState(pathCtx, update)
 			cause = update.cause
+		case <-deadline:
 		case <-pathCtx.Done():
 			q.terminate(pathCtx, cancelPath, LookupCancelled)
 		}
 
 		// calculate the maximum number of queries we could be spawning.
-		// Note: NumWaiting will be updated in spawnQuery
+		// Note: NumWaiting will be updated in spawnQuery. Up to alpha slow peers don't count, so that we hedge them
+		// with queries to other peers.
+		q.mu.Lock()
 		maxNumQueriesToSpawn := alpha - q.queryPeers.NumWaiting()
+		if numSlow := q.queryPeers.NumSlow(); numSlow > alpha {
+			maxNumQueriesToSpawn -= numSlow - alpha
+		}
 
 		// termination is triggered on end-of-lookup conditions or starvation of unused peers
 		// it also returns the peers we should query next for a maximum of `maxNumQueriesToSpawn` peers.
 		ready, reason, qPeers := q.isReadyToTerminate(pathCtx, maxNumQueriesToSpawn)
+		q.mu.Unlock()
 		if ready {
 			q.terminate(pathCtx, cancelPath, reason)
 		}
@@ -302,6 +620,17 @@ func (q *query) run() {
 
 		// try spawning the queries, if there are no available peers to query then we won't spawn them
 		for _, p := range qPeers {
+			if !q.params.budget.tryQuery(true) {
+				// another path may have used up the budget since we checked it, stop unless an update is coming
+				q.mu.Lock()
+				outstanding := q.numOutstanding()
+				q.mu.Unlock()
+				if outstanding == 0 {
+					q.terminate(pathCtx, cancelPath, LookupBudgetExhausted)
+					return
+				}
+				break
+			}
 			q.spawnQuery(pathCtx, cause, p, ch)
 		}
 	}
@@ -309,24 +638,24 @@ func (q *query) run() {
 
 // spawnQuery starts one query, if an available heard peer is found
 func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID, ch chan<- *queryUpdate) {
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
-			NewLookupUpdateEvent(
-				cause,
-				q.queryPeers.GetReferrer(queryPeer),
-				nil,                  // heard
-				[]peer.ID{queryPeer}, // waiting
-				nil,                  // queried
-				nil,                  // unreachable
-			),
-			nil,
-			nil,
+	q.mu.Lock()
+	referrer := q.queryPeers.GetReferrer(queryPeer)
+	q.mu.Unlock()
+	q.publishLookupEvent(ctx,
+		NewLookupUpdateEvent(
+			cause,
+			referrer,
+			nil,                  // heard
+			[]peer.ID{queryPeer}, // waiting
+			nil,                  // queried
+			nil,                  // unreachable
 		),
+		nil,
+		nil,
 	)
+	q.mu.Lock()
 	q.queryPeers.SetState(queryPeer, qpeerset.PeerWaiting)
+	q.mu.Unlock()
 	q.waitGroup.Add(1)
 	go q.queryPeer(ctx, ch, queryPeer)
 }
@@ -342,26 +671,47 @@ func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool
 	if q.isLookupTermination() {
 		return true, LookupCompleted, nil
 	}
+	// stop right away when we run out of time, or once we can't send any more queries and the queries we're waiting
+	// on are done
+	budget := q.params.budget
+	if budget.expired() || (budget.exhausted() && q.numOutstanding() == 0) {
+		return true, LookupBudgetExhausted, nil
+	}
 
-	// The peers we query next should be ones that we have only Heard about.
+	// The peers we query next should be ones that we have only Heard about, and that are close enough to us in
+	// referrals.
 	var peersToQuery []peer.ID
 	peers := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
-	count := 0
+	count, tooFar := 0, 0
 	for _, p := range peers {
-		peersToQuery = append(peersToQuery, p)
-		count++
 		if count == nPeersToQuery {
 			break
 		}
+		if budget.maxHops > 0 && q.hops(p) > budget.maxHops {
+			tooFar++
+			continue
+		}
+		peersToQuery = append(peersToQuery, p)
+		count++
+	}
+	if len(peersToQuery) == 0 && tooFar > 0 && q.numOutstanding() == 0 {
+		return true, LookupBudgetExhausted, nil
 	}
 
 	return false, -1, peersToQuery
 }
 
+// hops returns the number of referrals between us and p, 1 for the seed peers.
+func (q *query) hops(p peer.ID) int {
+	return q.peerHops[p]
+}
+
 // From the set of all nodes that are not unreachable,
 // if the closest beta nodes are all queried, the lookup can terminate.
+// The slow peers, that we hedge with queries to other peers, don't hold the lookup: their replies are only used if
+// they arrive before it terminates.
 func (q *query) isLookupTermination() bool {
-	peers := q.queryPeers.GetClosestNInStates(q.dht.beta, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	peers := q.queryPeers.GetClosestNInStates(q.params.beta, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
 	for _, p := range peers {
 		if q.queryPeers.GetState(p) != qpeerset.PeerQueried {
 			return false
@@ -370,8 +720,14 @@ func (q *query) isLookupTermination() bool {
 	return true
 }
 
+// The lookup starves once there are no peers left to query and no queries we're waiting on, slow ones included.
 func (q *query) isStarvationTermination() bool {
-	return q.queryPeers.NumHeard() == 0 && q.queryPeers.NumWaiting() == 0
+	return q.queryPeers.NumHeard() == 0 && q.numOutstanding() == 0
+}
+
+// numOutstanding returns the number of queries we're waiting on, slow ones included.
+func (q *query) numOutstanding() int {
+	return q.queryPeers.NumWaiting() + q.queryPeers.NumSlow()
 }
 
 func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason LookupTerminationReason) {
@@ -379,18 +735,28 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 		return
 	}
 
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
-			nil,
-			nil,
-			NewLookupTerminateEvent(reason),
-		),
-	)
+	q.publishLookupEvent(ctx, nil, nil, NewLookupTerminateEvent(reason))
 	cancel() // abort outstanding queries
 	q.terminated = true
+	q.mu.Lock()
+	q.reason = reason
+	q.mu.Unlock()
+}
+
+// publishLookupEvent publishes a lookup event for this query, tagged with the query's disjoint path.
+func (q *query) publishLookupEvent(ctx context.Context, request, response *LookupUpdateEvent, terminate *LookupTerminateEvent) {
+	ev := NewLookupEvent(q.dht.self, q.id, q.key, request, response, terminate)
+	ev.Path = q.path
+	PublishLookupEvent(ctx, ev)
+}
+
+// sendUpdate reports an update on the channel, unless the query path is over.
+// Once queries can be hedged, more queries than the channel can buffer may be outstanding.
+func (q *query) sendUpdate(ctx context.Context, ch chan<- *queryUpdate, up *queryUpdate) {
+	select {
+	case ch <- up:
+	case <-ctx.Done():
+	}
 }
 
 // queryPeer queries a single peer and reports its findings on the channel.
@@ -399,6 +765,23 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 	defer q.waitGroup.Done()
 	dialCtx, queryCtx := ctx, ctx
 
+	// report the peer as slow once it takes longer than it usually does, so that the lookup hedges it with a query
+	// to another peer.
+	if q.dht.hedgePercentile > 0 {
+		if deadline := q.dht.queryLatencies.deadline(p, q.dht.hedgePercentile); deadline > 0 {
+			q.waitGroup.Add(1)
+			timer := time.AfterFunc(deadline, func() {
+				defer q.waitGroup.Done()
+				q.sendUpdate(ctx, ch, &queryUpdate{cause: p, slow: []peer.ID{p}})
+			})
+			defer func() {
+				if timer.Stop() {
+					q.waitGroup.Done()
+				}
+			}()
+		}
+	}
+
 	startQuery := time.Now()
 	// dial the peer
 	if err := q.dht.dialPeer(dialCtx, p); err != nil {
@@ -406,7 +789,7 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		if dialCtx.Err() == nil {
 			q.dht.peerStoppedDHT(q.dht.ctx, p)
 		}
-		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		q.sendUpdate(ctx, ch, &queryUpdate{cause: p, unreachable: []peer.ID{p}})
 		return
 	}
 
@@ -416,11 +799,12 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		if queryCtx.Err() == nil {
 			q.dht.peerStoppedDHT(q.dht.ctx, p)
 		}
-		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		q.sendUpdate(ctx, ch, &queryUpdate{cause: p, unreachable: []peer.ID{p}})
 		return
 	}
 
 	queryDuration := time.Since(startQuery)
+	q.dht.queryLatencies.record(p, queryDuration)
 
 	// query successful, try to add to RT
 	q.dht.peerFound(q.dht.ctx, p, true)
@@ -444,41 +828,50 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		}
 	}
 
-	ch <- &queryUpdate{cause: p, heard: saw, queried: []peer.ID{p}, queryDuration: queryDuration}
+	q.sendUpdate(ctx, ch, &queryUpdate{cause: p, heard: saw, queried: []peer.ID{p}, queryDuration: queryDuration})
 }
 
 func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 	if q.terminated {
 		panic("update should not be invoked after the logical lookup termination")
 	}
-	PublishLookupEvent(ctx,
-		NewLookupEvent(
-			q.dht.self,
-			q.id,
-			q.key,
-			nil,
-			NewLookupUpdateEvent(
-				up.cause,
-				up.cause,
-				up.heard,       // heard
-				nil,            // waiting
-				up.queried,     // queried
-				up.unreachable, // unreachable
-			),
-			nil,
-		),
+	if q.claims != nil {
+		// ignore the peers that belong to other disjoint paths.
+		heard := make([]peer.ID, 0, len(up.heard))
+		for _, p := range up.heard {
+			if q.claims.claim(p, q.path) {
+				heard = append(heard, p)
+			}
+		}
+		up.heard = heard
+	}
+	response := NewLookupUpdateEvent(
+		up.cause,
+		up.cause,
+		up.heard,       // heard
+		nil,            // waiting
+		up.queried,     // queried
+		up.unreachable, // unreachable
 	)
+	response.Slow = NewPeerKadIDSlice(up.slow)
+	q.publishLookupEvent(ctx, nil, response, nil)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
 	for _, p := range up.heard {
 		if p == q.dht.self { // don't add self.
 			continue
 		}
-		q.queryPeers.TryAdd(p, up.cause)
+		if q.queryPeers.TryAdd(p, up.cause) {
+			// the peers the cause heard of are one hop further than the cause, 0 hops away if it is us.
+			q.peerHops[p] = q.peerHops[up.cause] + 1
+		}
 	}
 	for _, p := range up.queried {
 		if p == q.dht.self { // don't add self.
 			continue
 		}
-		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
+		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting || st == qpeerset.PeerSlow {
 			q.queryPeers.SetState(p, qpeerset.PeerQueried)
 			q.peerTimes[p] = up.queryDuration
 		} else {
@@ -490,12 +883,18 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 			continue
 		}
 
-		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
+		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting || st == qpeerset.PeerSlow {
 			q.queryPeers.SetState(p, qpeerset.PeerUnreachable)
 		} else {
 			panic(fmt.Errorf("kademlia protocol error: tried to transition to the unreachable state from state %v", st))
 		}
 	}
+	for _, p := range up.slow {
+		// the peer may have responded in the meantime.
+		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
+			q.queryPeers.SetState(p, qpeerset.PeerSlow)
+		}
+	}
 }
 
 func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
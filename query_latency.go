@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// latencySamplesPerPeer is the number of most recent query durations we keep per peer.
+	latencySamplesPerPeer = 16
+	// minPeerLatencySamples is the number of queries to a peer we need before relying on its own latency.
+	minPeerLatencySamples = 4
+	// globalLatencySamples is the number of most recent query durations we keep across all peers. They model the
+	// latency of peers we haven't queried often enough.
+	globalLatencySamples = 256
+	// minGlobalLatencySamples is the number of queries we need before relying on the latency across all peers.
+	minGlobalLatencySamples = 16
+	// maxLatencyModelPeers bounds the number of peers we keep query durations for.
+	maxLatencyModelPeers = 4096
+)
+
+// latencySamples is a ring buffer of query durations.
+type latencySamples struct {
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencySamples) add(d time.Duration, size int) {
+	if len(l.samples) < size {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % size
+}
+
+// percentile returns the duration below which the given fraction of the samples lies.
+func (l *latencySamples) percentile(pct float64) time.Duration {
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(pct * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// queryLatencyModel keeps the durations of recent successful queries, per peer and across all peers, so that lookups
+// can tell a peer that is slower than usual from one that is still working on a response.
+type queryLatencyModel struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*latencySamples
+	all   latencySamples
+}
+
+func newQueryLatencyModel() *queryLatencyModel {
+	return &queryLatencyModel{peers: make(map[peer.ID]*latencySamples)}
+}
+
+// record records the duration of a successful query to p.
+func (m *queryLatencyModel) record(p peer.ID, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	samples, ok := m.peers[p]
+	if !ok {
+		if len(m.peers) >= maxLatencyModelPeers {
+			// make room by forgetting an arbitrary peer.
+			for other := range m.peers {
+				delete(m.peers, other)
+				break
+			}
+		}
+		samples = &latencySamples{}
+		m.peers[p] = samples
+	}
+	samples.add(d, latencySamplesPerPeer)
+	m.all.add(d, globalLatencySamples)
+}
+
+// deadline returns the duration after which a query to p should be considered slow: the given percentile of the
+// recent queries to p, or of the recent queries to all peers if we haven't queried p often enough.
+// It returns 0 if we don't have enough samples yet.
+func (m *queryLatencyModel) deadline(p peer.ID, pct float64) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if samples, ok := m.peers[p]; ok && len(samples.samples) >= minPeerLatencySamples {
+		return samples.percentile(pct)
+	}
+	if len(m.all.samples) >= minGlobalLatencySamples {
+		return m.all.percentile(pct)
+	}
+	return 0
+}
@@ -3,9 +3,13 @@ package dht
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/peer"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	tu "github.com/libp2p/go-libp2p-testing/etc"
 
 	"github.com/stretchr/testify/require"
@@ -116,3 +120,332 @@ func checkRoutingTable(a, b *IpfsDHT) bool {
 	// under high load, this may not happen as immediately as we would like.
 	return a.routingTable.Find(b.self) != "" && b.routingTable.Find(a.self) != ""
 }
+
+func TestQueryHedging(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	querier := setupDHT(ctx, t, false, Concurrency(1), QueryHedging(0.9))
+	var peers []*IpfsDHT
+	for i := 0; i < 3; i++ {
+		d := setupDHT(ctx, t, false)
+		connect(t, ctx, querier, d)
+		peers = append(peers, d)
+	}
+	// the straggler is the first peer the lookup queries
+	straggler := querier.routingTable.NearestPeer(kb.ConvertKey("foo"))
+
+	// every peer usually responds within 10ms.
+	for i := 0; i < minGlobalLatencySamples; i++ {
+		querier.queryLatencies.record(peer.ID(fmt.Sprint(i)), 10*time.Millisecond)
+	}
+
+	evtCtx, events := RegisterForLookupEvents(ctx)
+	slow := make(chan peer.ID, 1)
+	go func() {
+		for e := range events {
+			if e.Response != nil && len(e.Response.Slow) > 0 {
+				select {
+				case slow <- e.Response.Slow[0].Peer:
+				default:
+				}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	queriedAt := make(map[peer.ID]time.Duration)
+	start := time.Now()
+	res, err := querier.runQuery(evtCtx, "foo", func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		mu.Lock()
+		queriedAt[p] = time.Since(start)
+		mu.Unlock()
+		if p == straggler {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+		return nil, nil
+	}, func() bool { return false })
+	require.NoError(t, err)
+	require.Equal(t, straggler, <-slow)
+	for _, d := range peers {
+		if d.self != straggler {
+			require.Less(t, int64(queriedAt[d.self]), int64(500*time.Millisecond), "the lookup didn't hedge the straggler")
+		}
+	}
+	// the lookup doesn't wait for the straggler, but still returns it
+	require.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	require.Contains(t, res.peers, straggler)
+	require.Len(t, res.peers, 3)
+}
+
+func TestLookupBudgets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	nDHTs := 20
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	// a line, so that every hop gets us one peer further
+	for i := 0; i < nDHTs-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+	querier := dhts[0]
+
+	terminations := func(ctx context.Context) (context.Context, <-chan LookupTerminationReason) {
+		ctx, events := RegisterForLookupEvents(ctx)
+		reasons := make(chan LookupTerminationReason, 1)
+		go func() {
+			for e := range events {
+				if e.Terminate != nil {
+					reasons <- e.Terminate.Reason
+				}
+			}
+		}()
+		return ctx, reasons
+	}
+	var mu sync.Mutex
+	queried := make(map[peer.ID]struct{})
+	queryFn := func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+		mu.Lock()
+		queried[p] = struct{}{}
+		mu.Unlock()
+		pmes, err := querier.findPeerSingle(ctx, p, peer.ID("foo"))
+		if err != nil {
+			return nil, err
+		}
+		return pb.PBPeersToPeerInfos(pmes.GetCloserPeers()), nil
+	}
+	stopFn := func() bool { return false }
+
+	t.Run("hops", func(t *testing.T) {
+		queried = make(map[peer.ID]struct{})
+		evtCtx, reasons := terminations(ctx)
+		res, err := querier.runQuery(evtCtx, "foo", queryFn, stopFn, LookupMaxHops(2))
+		require.NoError(t, err)
+		require.Equal(t, LookupBudgetExhausted, <-reasons)
+		require.False(t, res.completed)
+		// dhts[1] is one hop away, dhts[2] two hops away
+		require.Len(t, queried, 2)
+	})
+
+	t.Run("rpcs", func(t *testing.T) {
+		queried = make(map[peer.ID]struct{})
+		evtCtx, reasons := terminations(ctx)
+		res, err := querier.runLookupWithFollowup(evtCtx, "foo", queryFn, stopFn, LookupMaxRPCs(2))
+		require.NoError(t, err)
+		require.Equal(t, LookupBudgetExhausted, <-reasons)
+		require.False(t, res.completed)
+		require.Len(t, queried, 2)
+	})
+
+	t.Run("rpcs shared by disjoint paths", func(t *testing.T) {
+		// the paths of the querier race for the few RPCs of the lookup
+		d := setupDHT(ctx, t, false)
+		defer d.Close()
+		defer d.host.Close()
+		for _, other := range dhts {
+			connect(t, ctx, d, other)
+		}
+		// no deadline, so that only the budget can end the lookup
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		for i := 0; i < 50; i++ {
+			done := make(chan error, 1)
+			go func(maxRPCs int) {
+				_, err := d.runLookupWithFollowup(ctx, "foo", func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+					pmes, err := d.findPeerSingle(ctx, p, peer.ID("foo"))
+					if err != nil {
+						return nil, err
+					}
+					return pb.PBPeersToPeerInfos(pmes.GetCloserPeers()), nil
+				}, stopFn, LookupDisjointPaths(4), LookupMaxRPCs(maxRPCs))
+				done <- err
+			}(i%8 + 1)
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the lookup didn't end once its budget was used up")
+			}
+		}
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		evtCtx, reasons := terminations(ctx)
+		start := time.Now()
+		res, err := querier.runLookupWithFollowup(evtCtx, "foo", func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, stopFn, LookupMaxDuration(100*time.Millisecond))
+		require.NoError(t, err)
+		require.Equal(t, LookupBudgetExhausted, <-reasons)
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+		require.False(t, res.completed)
+		require.NotEmpty(t, res.peers)
+	})
+}
+
+func TestLookupSharing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 10
+	dhts := setupDHTS(t, ctx, nDHTs, EnableLookupSharing())
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+	querier := dhts[0]
+	require.True(t, querier.canShareLookup(ctx, nil))
+	unshared := setupDHT(ctx, t, false)
+	defer unshared.Close()
+	defer unshared.host.Close()
+	require.False(t, unshared.canShareLookup(ctx, nil), "lookup sharing should be opt-in")
+
+	t.Run("attach", func(t *testing.T) {
+		key := sharedLookupKey{kind: "test", key: "foo"}
+		release := make(chan struct{})
+		runs := 0
+		run := func(sl *sharedLookup) {
+			runs++
+			sl.publish(1)
+			<-release
+			sl.publish(2)
+		}
+
+		first := querier.sharedLookups.join(ctx, key, run)
+		r, ok := first.next(ctx, nil, 0)
+		require.True(t, ok)
+		require.Equal(t, 1, r)
+
+		// the second caller attaches to the running lookup and gets the results published before it attached
+		second := querier.sharedLookups.join(ctx, key, run)
+		require.True(t, first == second)
+		close(release)
+		for i, expected := range []int{1, 2} {
+			r, ok := second.next(ctx, nil, i)
+			require.True(t, ok)
+			require.Equal(t, expected, r)
+		}
+		_, ok = second.next(ctx, nil, 2)
+		require.False(t, ok)
+		first.leave(true)
+		second.leave(true)
+		require.Equal(t, 1, runs)
+
+		// the finished lookup isn't shared anymore
+		release = make(chan struct{})
+		close(release)
+		third := querier.sharedLookups.join(ctx, key, run)
+		require.False(t, first == third)
+		third.leave(true)
+	})
+
+	t.Run("abandon", func(t *testing.T) {
+		key := sharedLookupKey{kind: "test", key: "bar"}
+		cancelled := make(chan struct{})
+		sl := querier.sharedLookups.join(ctx, key, func(sl *sharedLookup) {
+			<-sl.ctx.Done()
+			close(cancelled)
+		})
+		sl.leave(true)
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("lookup wasn't cancelled once all callers left")
+		}
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		c := testCaseCids[0]
+		require.NoError(t, dhts[5].Provide(ctx, c, true))
+		require.NoError(t, dhts[7].PutValue(ctx, "/v/shared", []byte("value")))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				provs, err := querier.FindProviders(ctx, c)
+				require.NoError(t, err)
+				require.Len(t, provs, 1)
+				require.Equal(t, dhts[5].self, provs[0].ID)
+			}()
+			go func() {
+				defer wg.Done()
+				val, err := querier.GetValue(ctx, "/v/shared")
+				require.NoError(t, err)
+				require.Equal(t, []byte("value"), val)
+			}()
+		}
+		wg.Wait()
+
+		require.Eventually(t, func() bool {
+			querier.sharedLookups.mu.Lock()
+			defer querier.sharedLookups.mu.Unlock()
+			return len(querier.sharedLookups.running) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestClosestPeersCache(t *testing.T) {
+	c := newClosestPeersCache(100*time.Millisecond, 4)
+	require.Equal(t, c.region(kb.ID{0xab, 0xcd}), c.region(kb.ID{0xa0}))
+	require.NotEqual(t, c.region(kb.ID{0xab}), c.region(kb.ID{0xbb}))
+
+	peers := []peer.AddrInfo{{ID: peer.ID("a")}, {ID: peer.ID("b")}}
+	c.add(kb.ID{0xab}, peers)
+	require.Equal(t, peers, c.get(kb.ID{0xa1}))
+	require.Nil(t, c.get(kb.ID{0xb1}))
+	time.Sleep(150 * time.Millisecond)
+	require.Nil(t, c.get(kb.ID{0xa1}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 10
+	dhts := setupDHTS(t, ctx, nDHTs, ClosestPeersCache(time.Minute, 1))
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+	querier := dhts[0]
+
+	res, err := querier.GetClosestPeersDetailed(ctx, "foo")
+	require.NoError(t, err)
+	require.True(t, res.Completed)
+	cached := querier.closestPeersCache.get(kb.ConvertKey("foo"))
+	require.NotEmpty(t, cached)
+
+	// lookups for keys of the same region start from the cached peers
+	target := kb.ConvertKey("foo")
+	seeds := querier.nearestSeedPeers(target)
+	require.Contains(t, seeds, cached[0].ID)
+
+	// the results of seeded lookups are not cached
+	querier.closestPeersCache = newClosestPeersCache(time.Minute, 1)
+	seed := peer.AddrInfo{ID: dhts[5].self, Addrs: dhts[5].host.Addrs()}
+	res, err = querier.GetClosestPeersDetailed(ctx, "foo", LookupSeedPeers(seed))
+	require.NoError(t, err)
+	require.True(t, res.Completed)
+	require.Empty(t, querier.closestPeersCache.get(target))
+}
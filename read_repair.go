@@ -0,0 +1,287 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+)
+
+// defaultReadRepairTimeout is the default timeout for correcting a peer that returned an outdated value.
+const defaultReadRepairTimeout = 30 * time.Second
+
+// RepairOutcome is the outcome of the read-repair of a peer, i.e. of storing the value resolved by a search at a peer
+// that returned an outdated value or no value at all.
+type RepairOutcome int
+
+const (
+	// RepairSucceeded indicates that the peer stored the value.
+	RepairSucceeded RepairOutcome = iota
+	// RepairRejectedOld indicates that the peer refused the value because it has a better one.
+	RepairRejectedOld
+	// RepairFailed indicates that the peer couldn't be reached or refused the value for another reason.
+	RepairFailed
+	// RepairSkipped indicates that the repair wasn't attempted because of the read-repair rate limit.
+	RepairSkipped
+)
+
+func (o RepairOutcome) String() string {
+	switch o {
+	case RepairSucceeded:
+		return "succeeded"
+	case RepairRejectedOld:
+		return "rejected as old"
+	case RepairFailed:
+		return "failed"
+	case RepairSkipped:
+		return "skipped"
+	}
+	panic("unreachable")
+}
+
+// PeerRepair is the read-repair of a peer.
+type PeerRepair struct {
+	Peer    peer.ID
+	Outcome RepairOutcome
+	// Err is the error of a failed repair.
+	Err error
+}
+
+type readRepairConfig struct {
+	enabled      bool
+	closestPeers int
+	sync         bool
+	rate         float64
+	burst        int
+	concurrency  int
+}
+
+// readRepairer corrects the peers that returned an outdated value or no value at all to a search.
+type readRepairer struct {
+	readRepairConfig
+	timeout time.Duration
+
+	// limiter is nil if read-repairs aren't rate limited.
+	limiter *tokenBucket
+	// slots is nil if the number of concurrent read-repairs is unbounded.
+	slots chan struct{}
+}
+
+func newReadRepairer(cfg readRepairConfig, timeout time.Duration) *readRepairer {
+	rr := &readRepairer{readRepairConfig: cfg, timeout: timeout}
+	if cfg.rate > 0 {
+		rr.limiter = newTokenBucket(cfg.rate, cfg.burst)
+	}
+	if cfg.concurrency > 0 {
+		rr.slots = make(chan struct{}, cfg.concurrency)
+	}
+	return rr
+}
+
+// readRepair stores the resolved value at the closest peers of the lookup that didn't return it, unless read-repair
+// is disabled, the search stopped early or another caller sharing the lookup repaired it already. If wait is set or
+// read-repair is synchronous, it waits for the repairs and returns their outcomes, otherwise the repairs run in the
+// background and it returns nil.
+func (dht *IpfsDHT) readRepair(key string, rv *resolvedValue, wait bool) []PeerRepair {
+	rr := dht.readRepairer
+	if !rr.enabled || rv.val == nil || rv.lookupRes == nil {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&rv.lookupRes.repaired, 0, 1) {
+		return nil
+	}
+
+	candidates := rv.lookupRes.peers
+	if rr.closestPeers > 0 && len(candidates) > rr.closestPeers {
+		candidates = candidates[:rr.closestPeers]
+	}
+	peers := make([]peer.ID, 0, len(candidates))
+	for _, p := range candidates {
+		if _, ok := rv.peers[p]; !ok {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	repairs := make([]PeerRepair, len(peers))
+	fixupRec := record.MakePutRecord(key, rv.val)
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		repairs[i].Peer = p
+		if rr.limiter != nil && !rr.limiter.allow() {
+			repairs[i].Outcome = RepairSkipped
+			dht.recordRepair(RepairSkipped)
+			continue
+		}
+
+		wg.Add(1)
+		go func(repair *PeerRepair) {
+			defer wg.Done()
+			repair.Outcome, repair.Err = dht.repairPeer(dht.Context(), repair.Peer, fixupRec)
+			dht.recordRepair(repair.Outcome)
+			if repair.Err != nil {
+				logger.Debugw("error correcting DHT entry", "peer", repair.Peer, "key", loggableRecordKeyString(key), "outcome", repair.Outcome, "error", repair.Err)
+			}
+		}(&repairs[i])
+	}
+
+	if !wait && !rr.sync {
+		return nil
+	}
+	wg.Wait()
+	return repairs
+}
+
+func (dht *IpfsDHT) repairPeer(ctx context.Context, p peer.ID, fixupRec *recpb.Record) (RepairOutcome, error) {
+	//TODO: Is this possible?
+	if p == dht.self {
+		if err := dht.putLocal(string(fixupRec.GetKey()), fixupRec); err != nil {
+			logger.Error("Error correcting local dht entry:", err)
+			return RepairFailed, err
+		}
+		return RepairSucceeded, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dht.readRepairer.timeout)
+	defer cancel()
+
+	if slots := dht.readRepairer.slots; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return RepairFailed, ctx.Err()
+		}
+	}
+
+	err := dht.putValueToPeer(ctx, p, fixupRec)
+	if err == nil {
+		return RepairSucceeded, nil
+	}
+
+	// peers don't tell why they refused a value, ask the peer for the value it has to find out whether it is better
+	key := string(fixupRec.GetKey())
+	rec, _, getErr := dht.getValueOrPeers(ctx, p, key)
+	if getErr != nil || rec == nil {
+		return RepairFailed, err
+	}
+	if bytes.Equal(rec.GetValue(), fixupRec.GetValue()) {
+		return RepairSucceeded, nil
+	}
+	if sel, selErr := dht.Validator.Select(key, [][]byte{fixupRec.GetValue(), rec.GetValue()}); selErr == nil && sel == 1 {
+		return RepairRejectedOld, err
+	}
+	return RepairFailed, err
+}
+
+func (dht *IpfsDHT) recordRepair(outcome RepairOutcome) {
+	_ = stats.RecordWithTags(dht.ctx, []tag.Mutator{tag.Upsert(metrics.KeyRepairOutcome, outcome.String())},
+		metrics.ReadRepairs.M(1))
+}
+
+// defaultStaleValueThreshold is the default number of outdated values in a row a peer is evicted from the routing
+// table after.
+const defaultStaleValueThreshold = 3
+
+// staleValueCounts counts the outdated values in a row every peer of the routing table returned.
+type staleValueCounts struct {
+	// threshold is the count a peer is evicted from the routing table at, 0 if never.
+	threshold int
+
+	mu     sync.Mutex
+	counts map[peer.ID]int
+}
+
+// recordStaleValues counts that the stale peers returned an outdated value, which counts against their reliability,
+// and that the fresh peers returned the resolved value. The peers returning outdated values too often are evicted
+// from the routing table.
+func (dht *IpfsDHT) recordStaleValues(fresh map[peer.ID]struct{}, stale []peer.ID) {
+	// only count the peers of the routing table, that the counts are forgotten with
+	inRT := make([]peer.ID, 0, len(stale))
+	for _, p := range stale {
+		if dht.routingTable.Find(p) != "" {
+			inRT = append(inRT, p)
+		}
+	}
+
+	var evict []peer.ID
+	dht.staleValues.mu.Lock()
+	for p := range fresh {
+		delete(dht.staleValues.counts, p)
+	}
+	for _, p := range inRT {
+		dht.staleValues.counts[p]++
+		if t := dht.staleValues.threshold; t > 0 && dht.staleValues.counts[p] >= t {
+			evict = append(evict, p)
+		}
+	}
+	dht.staleValues.mu.Unlock()
+
+	for _, p := range evict {
+		logger.Debugw("evicting peer returning outdated values", "peer", p)
+		dht.routingTable.RemovePeer(p)
+	}
+	if len(stale) > 0 {
+		stats.Record(dht.ctx, metrics.StaleValues.M(int64(len(stale))))
+	}
+}
+
+// forgetStaleValues forgets the outdated values the peer returned, once it left the routing table.
+func (dht *IpfsDHT) forgetStaleValues(p peer.ID) {
+	dht.staleValues.mu.Lock()
+	delete(dht.staleValues.counts, p)
+	dht.staleValues.mu.Unlock()
+}
+
+// StaleValueCount returns the number of times in a row the peer returned an outdated value to a search for a value,
+// i.e. a valid value the validator rated worse than the value the search resolved. It is only counted for the peers
+// of the routing table (see StaleValueThreshold).
+func (dht *IpfsDHT) StaleValueCount(p peer.ID) int {
+	dht.staleValues.mu.Lock()
+	defer dht.staleValues.mu.Unlock()
+	return dht.staleValues.counts[p]
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -3,13 +3,24 @@ package dht
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/routing"
 
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/jbenet/goprocess"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
 )
 
+// publicKeyPublishPollInterval is how often the routing table is checked for peers to publish the public key to.
+const publicKeyPublishPollInterval = time.Second
+
+// publicKeyPublishMaxBackoff bounds the backoff between the retries of a failed public key publication.
+const publicKeyPublishMaxBackoff = 5 * time.Minute
+
 type pubkrs struct {
 	pubk ci.PubKey
 	err  error
@@ -17,6 +28,9 @@ type pubkrs struct {
 
 // GetPublicKey gets the public key when given a Peer ID. It will extract from
 // the Peer ID if inlined or ask the node it belongs to or ask the DHT.
+//
+// Concurrent calls for the same peer share a single fetch, and failures are
+// remembered for a while (see PublicKeyNegativeCacheTTL).
 func (dht *IpfsDHT) GetPublicKey(ctx context.Context, p peer.ID) (ci.PubKey, error) {
 	logger.Debugf("getPublicKey for: %s", p)
 
@@ -27,6 +41,20 @@ func (dht *IpfsDHT) GetPublicKey(ctx context.Context, p peer.ID) (ci.PubKey, err
 		return pk, nil
 	}
 
+	return dht.publicKeys.get(ctx, dht.ctx, p, dht.fetchPublicKey)
+}
+
+func (dht *IpfsDHT) fetchPublicKey(ctx context.Context, p peer.ID) (ci.PubKey, error) {
+	if err := dht.publicKeys.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer dht.publicKeys.release()
+
+	// the key may have been found while waiting
+	if pk := dht.peerstore.PubKey(p); pk != nil {
+		return pk, nil
+	}
+
 	// Try getting the public key both directly from the node it identifies
 	// and from the DHT, in parallel
 	ctx, cancel := context.WithCancel(ctx)
@@ -128,3 +156,71 @@ func (dht *IpfsDHT) getPublicKeyFromNode(ctx context.Context, p peer.ID) (ci.Pub
 	logger.Debugf("Got public key from node %v itself", p)
 	return pubk, nil
 }
+
+// selfPublicKeyRecord returns a fresh /pk record of this node's public key.
+func (dht *IpfsDHT) selfPublicKeyRecord() (*recpb.Record, error) {
+	pk := dht.peerstore.PubKey(dht.self)
+	if pk == nil {
+		return nil, fmt.Errorf("no public key for %s in the peerstore", dht.self)
+	}
+	pkbytes, err := ci.MarshalPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	rec := record.MakePutRecord(routing.KeyForPublicKey(dht.self), pkbytes)
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	return rec, nil
+}
+
+// storeSelfPublicKey stores the /pk record of this node's public key locally, so that peers asking this node for
+// its public key get it even if the key can't be extracted from its peer ID.
+func (dht *IpfsDHT) storeSelfPublicKey() error {
+	rec, err := dht.selfPublicKeyRecord()
+	if err != nil {
+		return err
+	}
+	return dht.putLocal(string(rec.GetKey()), rec)
+}
+
+// publishPublicKeyLoop publishes the /pk record of this node's public key to the network once the routing table has
+// peers, and republishes it every publicKeyRepublishInterval so that it doesn't expire. Failed publications are
+// retried with an exponential backoff, up to publicKeyPublishMaxBackoff or the republish interval if shorter.
+func (dht *IpfsDHT) publishPublicKeyLoop(proc goprocess.Process) {
+	pkkey := routing.KeyForPublicKey(dht.self)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	maxBackoff := publicKeyPublishMaxBackoff
+	if dht.publicKeyRepublishInterval < maxBackoff {
+		maxBackoff = dht.publicKeyRepublishInterval
+	}
+	backoff := publicKeyPublishPollInterval
+
+	for {
+		select {
+		case <-timer.C:
+		case <-proc.Closing():
+			return
+		}
+
+		if dht.routingTable.Size() == 0 {
+			timer.Reset(publicKeyPublishPollInterval)
+			continue
+		}
+
+		rec, err := dht.selfPublicKeyRecord()
+		if err == nil {
+			err = dht.PutValue(dht.ctx, pkkey, rec.GetValue())
+		}
+		if err != nil {
+			logger.Warnw("failed to publish public key", "error", err, "retry in", backoff)
+			timer.Reset(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = publicKeyPublishPollInterval
+		timer.Reset(dht.publicKeyRepublishInterval)
+	}
+}
@@ -307,6 +307,203 @@ func TestPubkeyGoodKeyFromDHTGoodKeyDirect(t *testing.T) {
 	}
 }
 
+// Check that a node serves its own public key record, and publishes it
+// to the network when asked to
+func TestPubkeySelfPublished(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false, PublishPublicKey(time.Hour))
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	pkkey := routing.KeyForPublicKey(dhtB.self)
+	rec, err := dhtB.getLocal(pkkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil {
+		t.Fatal("node B should have stored its public key")
+	}
+
+	// the record is served even once the stored one is gone
+	if err := dhtB.datastore.Delete(mkDsKey(pkkey)); err != nil {
+		t.Fatal(err)
+	}
+
+	connect(t, ctx, dhtA, dhtB)
+
+	res, err := dhtA.GetValueFromPeer(ctx, dhtB.self, pkkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubk, err := ci.UnmarshalPublicKey(res.Record.GetValue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubk.Equals(dhtB.peerstore.PubKey(dhtB.self)) {
+		t.Fatal("got incorrect public key")
+	}
+
+	// node B published its public key to node A
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, err := dhtA.getLocal(pkkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node A should have received the public key of node B")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Check that GetPublicKey() remembers the public keys it failed to fetch
+func TestPubkeyNegativeCache(t *testing.T) {
+	ctx := context.Background()
+
+	dhtA := setupDHT(ctx, t, false, PublicKeyNegativeCacheTTL(500*time.Millisecond))
+	dhtB := setupDHT(ctx, t, false)
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	// RSA keys can't be extracted from the peer ID
+	_, pubk, err := test.RandTestKeyPair(ci.RSA, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pubk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkkey := routing.KeyForPublicKey(id)
+	pkbytes, err := pubk.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dhtA.GetPublicKey(ctx, id); err == nil {
+		t.Fatal("Expected not found error")
+	}
+
+	// the key is published, but the failure is remembered until it expires
+	if err := dhtB.PutValue(ctx, pkkey, pkbytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := dhtA.datastore.Delete(mkDsKey(pkkey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dhtA.GetPublicKey(ctx, id); err == nil {
+		t.Fatal("Expected the failure to be remembered")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	rpubk, err := dhtA.GetPublicKey(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubk.Equals(rpubk) {
+		t.Fatal("got incorrect public key")
+	}
+
+	// the failures are bounded, and swept once expired
+	c := newPublicKeyCache(50*time.Millisecond, 1)
+	c.mu.Lock()
+	for i := 0; i <= maxPublicKeyFailures; i++ {
+		c.addFailureLocked(peer.ID(fmt.Sprint(i)), fmt.Errorf("failure %d", i))
+	}
+	n := len(c.failures)
+	_, oldest := c.failures[peer.ID("0")]
+	c.mu.Unlock()
+	if n != maxPublicKeyFailures || oldest {
+		t.Fatalf("expected the %d most recent failures, got %d", maxPublicKeyFailures, n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.sweep()
+	if len(c.failures) != 0 || c.failureOrder.Len() != 0 {
+		t.Fatal("expected the expired failures to be swept")
+	}
+}
+
+// Check that GetPublicKeys() fetches the public keys of many peers
+func TestPubkeysBatch(t *testing.T) {
+	ctx := context.Background()
+
+	dhtA := setupDHT(ctx, t, false, PublicKeyFetchConcurrency(2))
+	dhtB := setupDHT(ctx, t, false)
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	// RSA keys can't be extracted from the peer ID
+	var peers []peer.ID
+	pubks := make(map[peer.ID]ci.PubKey)
+	for i := 0; i < 6; i++ {
+		_, pubk, err := test.RandTestKeyPair(ci.RSA, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := peer.IDFromPublicKey(pubk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, id)
+		pubks[id] = pubk
+	}
+	missing := peers[5]
+	peers = peers[:5]
+	for _, p := range peers {
+		pkbytes, err := pubks[p].Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dhtB.PutValue(ctx, routing.KeyForPublicKey(p), pkbytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// duplicates share a single fetch
+	peers = append(peers, missing, peers[0])
+
+	results := dhtA.GetPublicKeys(ctx, peers)
+	if len(results) != len(peers) {
+		t.Fatalf("expected %d results, got %d", len(peers), len(results))
+	}
+	for i, res := range results {
+		if res.Peer != peers[i] {
+			t.Fatal("results out of order")
+		}
+		if res.Peer == missing {
+			if res.Err == nil || res.Key != nil {
+				t.Fatal("Expected not found error")
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if !pubks[res.Peer].Equals(res.Key) {
+			t.Fatal("got incorrect public key")
+		}
+	}
+}
+
 func TestValuesDisabled(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		enabledA := (i & 0x1) > 0
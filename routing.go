@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
@@ -47,13 +48,20 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 
 	// Check if we have an old value that's not the same as the new one.
 	if old != nil && !bytes.Equal(old.GetValue(), value) {
-		// Check to see if the new one is better.
-		i, err := dht.Validator.Select(key, [][]byte{value, old.GetValue()})
-		if err != nil {
-			return err
-		}
-		if i != 0 {
-			return fmt.Errorf("can't replace a newer value with an older value")
+		if mv := dht.mergingValidator(key); mv != nil {
+			// merge the new value into the old one
+			if value, err = mv.Merge(key, [][]byte{old.GetValue(), value}); err != nil {
+				return err
+			}
+		} else {
+			// Check to see if the new one is better.
+			i, err := dht.Validator.Select(key, [][]byte{value, old.GetValue()})
+			if err != nil {
+				return err
+			}
+			if i != 0 {
+				return fmt.Errorf("can't replace a newer value with an older value")
+			}
 		}
 	}
 
@@ -63,14 +71,17 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	if err != nil {
 		return err
 	}
+	dht.invalidateNotFound(negativeCacheValue, key)
 
-	pchan, err := dht.GetClosestPeers(ctx, key)
+	closest, err := dht.GetClosestPeersDetailed(ctx, key, opts...)
 	if err != nil {
 		return err
 	}
 
+	peers := closest.PeerIDs()
+	var stored int32
 	wg := sync.WaitGroup{}
-	for p := range pchan {
+	for _, p := range peers {
 		wg.Add(1)
 		go func(p peer.ID) {
 			ctx, cancel := context.WithCancel(ctx)
@@ -84,11 +95,17 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 			err := dht.putValueToPeer(ctx, p, rec)
 			if err != nil {
 				logger.Debugf("failed putting value to peer: %s", err)
+				return
 			}
+			atomic.AddInt32(&stored, 1)
 		}(p)
 	}
 	wg.Wait()
 
+	// the peers merging the value into theirs refuse it if it doesn't fit, e.g. into a full set
+	if len(peers) > 0 && stored == 0 && dht.mergingValidator(key) != nil {
+		return fmt.Errorf("failed to put the value to any of the %d closest peers", len(peers))
+	}
 	return nil
 }
 
@@ -133,6 +150,13 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 }
 
 // SearchValue searches for the value corresponding to given Key and streams the results.
+//
+// By default the best value so far according to the validator is streamed, and
+// the search stops after Quorum values. Other strategies can be chosen with
+// FirstValidValue, QuorumAgreement, FreshestValue and ClosestPeersValue.
+//
+// With EnableLookupSharing, concurrent searches for the same key share a single
+// lookup, unless they override the lookup parameters or follow the query events.
 func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
 	if !dht.enableValues {
 		return nil, routing.ErrNotSupported
@@ -149,60 +173,18 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing
 	}
 
 	stopCh := make(chan struct{})
-	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+	valCh, lookupResCh := dht.getValues(ctx, key, stopCh, opts...)
 
 	out := make(chan []byte)
 	go func() {
 		defer close(out)
-		best, peersWithBest, aborted := dht.searchValueQuorum(ctx, key, valCh, stopCh, out, responsesNeeded)
-		if best == nil || aborted {
-			return
-		}
-
-		updatePeers := make([]peer.ID, 0, dht.bucketSize)
-		select {
-		case l := <-lookupRes:
-			if l == nil {
-				return
-			}
-
-			for _, p := range l.peers {
-				if _, ok := peersWithBest[p]; !ok {
-					updatePeers = append(updatePeers, p)
-				}
-			}
-		case <-ctx.Done():
-			return
-		}
-
-		dht.updatePeerValues(dht.Context(), key, best, updatePeers)
+		rv := dht.resolveValue(ctx, key, getValueResolution(&cfg), responsesNeeded, valCh, lookupResCh, stopCh, out)
+		dht.readRepair(key, rv, false)
 	}()
 
 	return out, nil
 }
 
-func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-chan RecvdVal, stopCh chan struct{},
-	out chan<- []byte, nvals int) ([]byte, map[peer.ID]struct{}, bool) {
-	numResponses := 0
-	return dht.processValues(ctx, key, valCh,
-		func(ctx context.Context, v RecvdVal, better bool) bool {
-			numResponses++
-			if better {
-				select {
-				case out <- v.Val:
-				case <-ctx.Done():
-					return false
-				}
-			}
-
-			if nvals > 0 && numResponses > nvals {
-				close(stopCh)
-				return true
-			}
-			return false
-		})
-}
-
 // GetValues gets nvals values corresponding to the given key.
 func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) (_ []RecvdVal, err error) {
 	if !dht.enableValues {
@@ -226,6 +208,7 @@ func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) (_ []R
 
 func (dht *IpfsDHT) processValues(ctx context.Context, key string, vals <-chan RecvdVal,
 	newVal func(ctx context.Context, v RecvdVal, better bool) bool) (best []byte, peersWithBest map[peer.ID]struct{}, aborted bool) {
+	mv := dht.mergingValidator(key)
 loop:
 	for {
 		if aborted {
@@ -245,6 +228,27 @@ loop:
 					aborted = newVal(ctx, v, false)
 					continue
 				}
+				if mv != nil {
+					// the best value is the union of the values
+					merged, err := mv.Merge(key, [][]byte{best, v.Val})
+					if err != nil {
+						// keep the best value, e.g. if it is full already
+						logger.Debugw("failed to merge values", "key", loggableRecordKeyString(key), "error", err)
+						continue
+					}
+					if bytes.Equal(merged, best) {
+						aborted = newVal(ctx, v, false)
+						continue
+					}
+					peersWithBest = make(map[peer.ID]struct{})
+					if bytes.Equal(merged, v.Val) {
+						peersWithBest[v.From] = struct{}{}
+					}
+					best = merged
+					v.Val = merged
+					aborted = newVal(ctx, v, true)
+					continue
+				}
 				sel, err := dht.Validator.Select(key, [][]byte{best, v.Val})
 				if err != nil {
 					logger.Warnw("failed to select best value", "key", loggableRecordKeyString(key), "error", err)
@@ -267,35 +271,25 @@ loop:
 	return
 }
 
-func (dht *IpfsDHT) updatePeerValues(ctx context.Context, key string, val []byte, peers []peer.ID) {
-	fixupRec := record.MakePutRecord(key, val)
-	for _, p := range peers {
-		go func(p peer.ID) {
-			//TODO: Is this possible?
-			if p == dht.self {
-				err := dht.putLocal(key, fixupRec)
-				if err != nil {
-					logger.Error("Error correcting local dht entry:", err)
-				}
-				return
-			}
-			ctx, cancel := context.WithTimeout(ctx, time.Second*30)
-			defer cancel()
-			err := dht.putValueToPeer(ctx, p, fixupRec)
-			if err != nil {
-				logger.Debug("Error correcting DHT entry: ", err)
-			}
-		}(p)
+func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan struct{}, opts ...routing.Option) (<-chan RecvdVal, <-chan *lookupWithFollowupResult) {
+	if dht.canShareLookup(ctx, opts) {
+		return dht.getValuesShared(ctx, key, stopQuery)
 	}
+	return dht.getValuesUnshared(ctx, key, stopQuery, nil, opts...)
 }
 
-func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan struct{}) (<-chan RecvdVal, <-chan *lookupWithFollowupResult) {
+// getValuesUnshared runs a lookup for the values of the key. If prov isn't nil, the responses of the peers are recorded
+// in it.
+func (dht *IpfsDHT) getValuesUnshared(ctx context.Context, key string, stopQuery chan struct{}, prov *valueProvenance, opts ...routing.Option) (<-chan RecvdVal, <-chan *lookupWithFollowupResult) {
 	valCh := make(chan RecvdVal, 1)
 	lookupResCh := make(chan *lookupWithFollowupResult, 1)
 
 	logger.Debugw("finding value", "key", loggableRecordKeyString(key))
 
+	var found int32
 	if rec, err := dht.getLocal(key); rec != nil && err == nil {
+		found = 1
+		prov.record(dht.self, rec, nil)
 		select {
 		case valCh <- RecvdVal{
 			Val:  rec.GetValue(),
@@ -305,6 +299,13 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 		}
 	}
 
+	if dht.cachedNotFound(ctx, negativeCacheValue, key, opts...) {
+		logger.Debugw("value recently not found", "key", loggableRecordKeyString(key))
+		close(valCh)
+		close(lookupResCh)
+		return valCh, lookupResCh
+	}
+
 	go func() {
 		defer close(valCh)
 		defer close(lookupResCh)
@@ -326,16 +327,19 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 						Type: routing.PeerResponse,
 						ID:   p,
 					})
+					prov.record(p, nil, err)
 					return nil, err
 				default:
 					return nil, err
 				case nil, errInvalidRecord:
 					// in either of these cases, we want to keep going
 				}
+				prov.record(p, rec, err)
 
 				// TODO: What should happen if the record is invalid?
 				// Pre-existing code counted it towards the quorum, but should it?
-				if rec != nil && rec.GetValue() != nil {
+				if err == nil && rec != nil && rec.GetValue() != nil {
+					atomic.StoreInt32(&found, 1)
 					rv := RecvdVal{
 						Val:  rec.GetValue(),
 						From: p,
@@ -365,11 +369,15 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 					return false
 				}
 			},
+			opts...,
 		)
 
 		if err != nil {
 			return
 		}
+		if atomic.LoadInt32(&found) == 0 {
+			dht.cacheNotFound(negativeCacheValue, key, lookupRes)
+		}
 		lookupResCh <- lookupRes
 
 		if ctx.Err() == nil {
@@ -403,10 +411,15 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 
 	// add self locally
 	dht.ProviderManager.AddProvider(ctx, keyMH, dht.self)
+	dht.invalidateNotFound(negativeCacheProviders, string(keyMH))
 	if !brdcst {
 		return nil
 	}
 
+	if dht.enableOptimisticProvide {
+		return dht.optimisticProvide(ctx, keyMH)
+	}
+
 	closerCtx := ctx
 	if deadline, ok := ctx.Deadline(); ok {
 		now := time.Now()
@@ -429,7 +442,7 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 	}
 
 	var exceededDeadline bool
-	peers, err := dht.GetClosestPeers(closerCtx, string(keyMH))
+	closest, err := dht.GetClosestPeersDetailed(closerCtx, string(keyMH))
 	switch err {
 	case context.DeadlineExceeded:
 		// If the _inner_ deadline has been exceeded but the _outer_
@@ -450,7 +463,7 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 	}
 
 	wg := sync.WaitGroup{}
-	for p := range peers {
+	for _, p := range closest.PeerIDs() {
 		wg.Add(1)
 		go func(p peer.ID) {
 			defer wg.Done()
@@ -504,6 +517,13 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrIn
 // the search query completes. If count is zero then the query will run until it
 // completes. Note: not reading from the returned channel may block the query
 // from progressing.
+//
+// The lookup parameters can be overridden with routing options attached to the
+// context with WithRoutingOptions.
+//
+// With EnableLookupSharing, concurrent calls for the same key and count share a
+// single lookup, unless they override the lookup parameters or follow the query
+// events.
 func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
 	if !dht.enableProviders || !key.Defined() {
 		peerOut := make(chan peer.AddrInfo)
@@ -520,7 +540,11 @@ func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count i
 	keyMH := key.Hash()
 
 	logger.Debugw("finding providers", "cid", key, "mh", loggableProviderRecordBytes(keyMH))
-	go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
+	if dht.canShareLookup(ctx, nil) {
+		go dht.findProvidersShared(ctx, keyMH, count, peerOut)
+	} else {
+		go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
+	}
 	return peerOut
 }
 
@@ -554,6 +578,11 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 		}
 	}
 
+	if dht.cachedNotFound(ctx, negativeCacheProviders, string(key)) {
+		logger.Debugw("providers recently not found", "mh", loggableProviderRecordBytes(key))
+		return
+	}
+
 	lookupRes, err := dht.runLookupWithFollowup(ctx, string(key),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
@@ -608,12 +637,18 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 		},
 	)
 
+	if err == nil && ps.Size() == 0 {
+		dht.cacheNotFound(negativeCacheProviders, string(key), lookupRes)
+	}
 	if err == nil && ctx.Err() == nil {
 		dht.refreshRTIfNoShortcut(kb.ConvertKey(string(key)), lookupRes)
 	}
 }
 
 // FindPeer searches for a peer with given ID.
+//
+// The lookup parameters can be overridden with routing options attached to the
+// context with WithRoutingOptions.
 func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo, err error) {
 	if err := id.Validate(); err != nil {
 		return peer.AddrInfo{}, err
@@ -626,6 +661,10 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		return pi, nil
 	}
 
+	if dht.cachedNotFound(ctx, negativeCachePeer, string(id)) {
+		return peer.AddrInfo{}, routing.ErrNotFound
+	}
+
 	lookupRes, err := dht.runLookupWithFollowup(ctx, string(id),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
@@ -665,7 +704,7 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 			// Note: we consider PeerUnreachable to be a valid state because the peer may not support the DHT protocol
 			// and therefore the peer would fail the query. The fact that a peer that is returned can be a non-DHT
 			// server peer and is not identified as such is a bug.
-			dialedPeerDuringQuery = (lookupRes.state[i] == qpeerset.PeerQueried || lookupRes.state[i] == qpeerset.PeerUnreachable || lookupRes.state[i] == qpeerset.PeerWaiting)
+			dialedPeerDuringQuery = (lookupRes.state[i] == qpeerset.PeerQueried || lookupRes.state[i] == qpeerset.PeerUnreachable || lookupRes.state[i] == qpeerset.PeerWaiting || lookupRes.state[i] == qpeerset.PeerSlow)
 			break
 		}
 	}
@@ -677,5 +716,6 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		return dht.peerstore.PeerInfo(id), nil
 	}
 
+	dht.cacheNotFound(negativeCachePeer, string(id), lookupRes)
 	return peer.AddrInfo{}, routing.ErrNotFound
 }
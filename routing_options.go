@@ -1,6 +1,13 @@
 package dht
 
-import "github.com/libp2p/go-libp2p-core/routing"
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+)
 
 type quorumOptionKey struct{}
 
@@ -28,3 +35,278 @@ func getQuorum(opts *routing.Options, ndefault int) int {
 	}
 	return responsesNeeded
 }
+
+type valueResolutionOptionKey struct{}
+
+// valueResolutionMode is a strategy deciding which value a search for a value returns, and when it stops.
+type valueResolutionMode int
+
+const (
+	// resolveBest streams the best value so far according to Validator.Select, stopping after Quorum values.
+	resolveBest valueResolutionMode = iota
+	resolveFirstValid
+	resolveQuorumAgreement
+	resolveFreshest
+	resolveClosestPeers
+)
+
+type valueResolution struct {
+	mode valueResolutionMode
+	n    int
+}
+
+func valueResolutionOption(res valueResolution) routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[valueResolutionOptionKey{}] = res
+		return nil
+	}
+}
+
+// FirstValidValue is a DHT option that makes a search for a value return the first valid value it receives and stop.
+func FirstValidValue() routing.Option {
+	return valueResolutionOption(valueResolution{mode: resolveFirstValid})
+}
+
+// QuorumAgreement is a DHT option that makes a search for a value return a value once n peers returned identical
+// bytes, and stop. Nothing is returned if no value reaches n peers.
+func QuorumAgreement(n int) routing.Option {
+	if n < 1 {
+		return func(*routing.Options) error {
+			return fmt.Errorf("quorum agreement must be at least 1, got %d", n)
+		}
+	}
+	return valueResolutionOption(valueResolution{mode: resolveQuorumAgreement, n: n})
+}
+
+// FreshestValue is a DHT option that makes a search for a value wait for values from minResponses peers and return
+// the best (i.e. freshest) of them according to Validator.Select, and stop. Nothing is returned if fewer peers return
+// a value.
+func FreshestValue(minResponses int) routing.Option {
+	if minResponses < 1 {
+		return func(*routing.Options) error {
+			return fmt.Errorf("freshest value min responses must be at least 1, got %d", minResponses)
+		}
+	}
+	return valueResolutionOption(valueResolution{mode: resolveFreshest, n: minResponses})
+}
+
+// ClosestPeersValue is a DHT option that makes a search for a value run until the lookup ends and return the best
+// value according to Validator.Select among the values of the K closest peers to the key the lookup found, ignoring
+// the values of the peers further away. The local value is only considered if this node is closer to the key than the
+// furthest of these peers.
+func ClosestPeersValue() routing.Option {
+	return valueResolutionOption(valueResolution{mode: resolveClosestPeers})
+}
+
+func getValueResolution(opts *routing.Options) valueResolution {
+	res, _ := opts.Other[valueResolutionOptionKey{}].(valueResolution)
+	return res
+}
+
+type routingOptionsCtxKey struct{}
+
+// WithRoutingOptions attaches routing options to the context, so that they apply to the lookups done on behalf of
+// calls that don't take routing options, like FindProvidersAsync and FindPeer. Options passed to a call directly take
+// precedence over the ones attached to its context.
+func WithRoutingOptions(ctx context.Context, opts ...routing.Option) context.Context {
+	if prev := routingOptionsFromContext(ctx); len(prev) > 0 {
+		opts = append(append([]routing.Option{}, prev...), opts...)
+	}
+	return context.WithValue(ctx, routingOptionsCtxKey{}, opts)
+}
+
+func routingOptionsFromContext(ctx context.Context) []routing.Option {
+	opts, _ := ctx.Value(routingOptionsCtxKey{}).([]routing.Option)
+	return opts
+}
+
+type disjointPathsOptionKey struct{}
+
+// LookupDisjointPaths is a DHT option that overrides the number of disjoint paths (see DisjointPaths) of the lookups
+// done for a single call.
+func LookupDisjointPaths(d int) routing.Option {
+	return intLookupOption(disjointPathsOptionKey{}, "disjoint paths", d, 1)
+}
+
+func getDisjointPaths(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, disjointPathsOptionKey{}, ndefault)
+}
+
+type concurrencyOptionKey struct{}
+
+// LookupConcurrency is a DHT option that overrides the number of concurrent requests per path (alpha, see
+// Concurrency) of the lookups done for a single call.
+func LookupConcurrency(alpha int) routing.Option {
+	return intLookupOption(concurrencyOptionKey{}, "lookup concurrency", alpha, 1)
+}
+
+func getLookupConcurrency(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, concurrencyOptionKey{}, ndefault)
+}
+
+type resiliencyOptionKey struct{}
+
+// LookupResiliency is a DHT option that overrides the number of peers closest to the target that must have
+// responded for a lookup path to terminate (beta, see Resiliency) for the lookups done for a single call.
+func LookupResiliency(beta int) routing.Option {
+	return intLookupOption(resiliencyOptionKey{}, "lookup resiliency", beta, 1)
+}
+
+func getLookupResiliency(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, resiliencyOptionKey{}, ndefault)
+}
+
+type resultSizeOptionKey struct{}
+
+// LookupResultSize is a DHT option that overrides the number of closest peers the lookups done for a single call
+// return (and, for GetValue and FindProvidersAsync, query in their follow-up).
+//
+// Default: the bucket size
+func LookupResultSize(n int) routing.Option {
+	return intLookupOption(resultSizeOptionKey{}, "lookup result size", n, 1)
+}
+
+func getLookupResultSize(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, resultSizeOptionKey{}, ndefault)
+}
+
+type maxPeersOptionKey struct{}
+
+// LookupMaxPeers is a DHT option that limits the number of peers each lookup done for a single call contacts. A
+// lookup that runs out of budget returns the closest peers it found so far. Zero means no limit.
+// See also LookupMaxRPCs, LookupMaxHops and LookupMaxDuration.
+//
+// Default: 0
+func LookupMaxPeers(n int) routing.Option {
+	return intLookupOption(maxPeersOptionKey{}, "lookup max peers", n, 0)
+}
+
+func getLookupMaxPeers(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, maxPeersOptionKey{}, ndefault)
+}
+
+type maxRPCsOptionKey struct{}
+
+// LookupMaxRPCs is a DHT option that limits the number of queries each lookup done for a single call sends,
+// including the follow-up queries to the closest peers. A lookup that runs out of budget returns the closest peers
+// it found so far. Zero means no limit.
+//
+// Default: 0
+func LookupMaxRPCs(n int) routing.Option {
+	return intLookupOption(maxRPCsOptionKey{}, "lookup max RPCs", n, 0)
+}
+
+func getLookupMaxRPCs(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, maxRPCsOptionKey{}, ndefault)
+}
+
+type maxHopsOptionKey struct{}
+
+// LookupMaxHops is a DHT option that limits how deep each lookup done for a single call follows referrals: the
+// lookups only query peers at most n referrals away, the closest peers in our routing table being one referral away.
+// A lookup that runs out of budget returns the closest peers it found so far. Zero means no limit.
+//
+// Default: 0
+func LookupMaxHops(n int) routing.Option {
+	return intLookupOption(maxHopsOptionKey{}, "lookup max hops", n, 0)
+}
+
+func getLookupMaxHops(opts *routing.Options, ndefault int) int {
+	return getIntLookupOption(opts, maxHopsOptionKey{}, ndefault)
+}
+
+type maxDurationOptionKey struct{}
+
+// LookupMaxDuration is a DHT option that limits how long each lookup done for a single call runs, including the
+// follow-up queries to the closest peers. Unlike a context deadline, a lookup that runs out of time returns the
+// closest peers it found so far rather than an error. Zero means no limit.
+//
+// Default: 0
+func LookupMaxDuration(d time.Duration) routing.Option {
+	return func(opts *routing.Options) error {
+		if d < 0 {
+			return fmt.Errorf("lookup max duration must be non-negative, got %s", d)
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[maxDurationOptionKey{}] = d
+		return nil
+	}
+}
+
+func getLookupMaxDuration(opts *routing.Options, ddefault time.Duration) time.Duration {
+	d, ok := opts.Other[maxDurationOptionKey{}].(time.Duration)
+	if !ok {
+		d = ddefault
+	}
+	return d
+}
+
+type seedPeersOptionKey struct{}
+
+// LookupSeedPeers is a DHT option that starts the lookups done for a single call from the given peers, instead of
+// the closest peers in the routing table: e.g. peers learned out-of-band, the result of a previous lookup or a set of
+// trusted peers. The addresses of the peers, if any, are added to the peerstore.
+func LookupSeedPeers(peers ...peer.AddrInfo) routing.Option {
+	return func(opts *routing.Options) error {
+		if len(peers) == 0 {
+			return fmt.Errorf("lookup seed peers must not be empty")
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[seedPeersOptionKey{}] = peers
+		return nil
+	}
+}
+
+func getLookupSeedPeers(opts *routing.Options) []peer.AddrInfo {
+	peers, _ := opts.Other[seedPeersOptionKey{}].([]peer.AddrInfo)
+	return peers
+}
+
+type bypassNegativeCacheOptionKey struct{}
+
+// BypassNegativeCache is a DHT option that makes a single call run its lookup even if a recent lookup for the key
+// found nothing (see NegativeCache). The result of the lookup is still recorded in the negative cache.
+func BypassNegativeCache() routing.Option {
+	return func(opts *routing.Options) error {
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[bypassNegativeCacheOptionKey{}] = true
+		return nil
+	}
+}
+
+func getBypassNegativeCache(opts *routing.Options) bool {
+	bypass, _ := opts.Other[bypassNegativeCacheOptionKey{}].(bool)
+	return bypass
+}
+
+// intLookupOption returns a routing option setting the integer lookup parameter under key to n, which must be at
+// least min.
+func intLookupOption(key interface{}, name string, n, min int) routing.Option {
+	return func(opts *routing.Options) error {
+		if n < min {
+			return fmt.Errorf("%s must be at least %d, got %d", name, min, n)
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[key] = n
+		return nil
+	}
+}
+
+func getIntLookupOption(opts *routing.Options, key interface{}, ndefault int) int {
+	n, ok := opts.Other[key].(int)
+	if !ok {
+		n = ndefault
+	}
+	return n
+}
@@ -18,9 +18,8 @@ import (
 
 var logger = logging.Logger("dht/RtRefreshManager")
 
-const (
-	peerPingTimeout = 10 * time.Second
-)
+// DefaultPeerPingTimeout is the default timeout for checking the liveliness of a peer we haven't heard from in a while.
+const DefaultPeerPingTimeout = 10 * time.Second
 
 type triggerRefreshReq struct {
 	respCh          chan error
@@ -42,6 +41,7 @@ type RtRefreshManager struct {
 	refreshKeyGenFnc    func(cpl uint) (string, error)              // generate the key for the query to refresh this cpl
 	refreshQueryFnc     func(ctx context.Context, key string) error // query to run for a refresh.
 	refreshQueryTimeout time.Duration                               // timeout for one refresh query
+	peerPingTimeout     time.Duration                               // timeout for one liveliness check
 
 	// interval between two periodic refreshes.
 	// also, a cpl wont be refreshed if the time since it was last refreshed
@@ -75,6 +75,7 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 		refreshQueryFnc:   refreshQueryFnc,
 
 		refreshQueryTimeout:                refreshQueryTimeout,
+		peerPingTimeout:                    DefaultPeerPingTimeout,
 		refreshInterval:                    refreshInterval,
 		successfulOutboundQueryGracePeriod: successfulOutboundQueryGracePeriod,
 
@@ -83,6 +84,12 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 	}, nil
 }
 
+// SetPeerPingTimeout sets the timeout for checking the liveliness of a peer, DefaultPeerPingTimeout by default. It must
+// be called before Start.
+func (r *RtRefreshManager) SetPeerPingTimeout(timeout time.Duration) {
+	r.peerPingTimeout = timeout
+}
+
 func (r *RtRefreshManager) Start() error {
 	r.refcount.Add(1)
 	go r.loop()
@@ -175,7 +182,7 @@ func (r *RtRefreshManager) loop() {
 				wg.Add(1)
 				go func(ps kbucket.PeerInfo) {
 					defer wg.Done()
-					livelinessCtx, cancel := context.WithTimeout(r.ctx, peerPingTimeout)
+					livelinessCtx, cancel := context.WithTimeout(r.ctx, r.peerPingTimeout)
 					if err := r.h.Connect(livelinessCtx, peer.AddrInfo{ID: ps.Id}); err != nil {
 						logger.Debugw("evicting peer after failed ping", "peer", ps.Id, "error", err)
 						r.rt.RemovePeer(ps.Id)
@@ -0,0 +1,252 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// defaultMaxSetEntries is the default maximum number of entries of a set-valued record.
+const defaultMaxSetEntries = 1024
+
+// setValuePrefix starts every encoded set of entries.
+const setValuePrefix = "/dht-set/1\n"
+
+// setEntrySignaturePrefix separates the signatures of set entries from the other signatures of the same key.
+const setEntrySignaturePrefix = "dht-set-entry:"
+
+var errInvalidSetValue = errors.New("invalid set value")
+
+// ErrSetFull is returned when entries can't be added to a set-valued record because it is full.
+var ErrSetFull = errors.New("set is full")
+
+// MergingValidator is a record.Validator whose values are merged instead of replacing each other: the servers merge
+// the values put to them into the value they store, and the values found by a search are merged into the value it
+// returns. The DHT uses the MergingValidator of a key, if any, instead of Select, be it the validator of the DHT or,
+// with a record.NamespacedValidator, the validator of the namespace of the key.
+type MergingValidator interface {
+	record.Validator
+	// Merge merges valid values of the key into a valid value. It fails if the merged value can't hold the values,
+	// e.g. with ErrSetFull, in which case the first value is kept by the servers and the readers.
+	Merge(key string, values [][]byte) ([]byte, error)
+}
+
+// mergingValidator returns the MergingValidator of the key, nil if the key has none.
+func (dht *IpfsDHT) mergingValidator(key string) MergingValidator {
+	v := dht.Validator
+	if nsval, ok := v.(record.NamespacedValidator); ok {
+		v = nsval.ValidatorByKey(key)
+	}
+	mv, _ := v.(MergingValidator)
+	return mv
+}
+
+// SetEntry is an entry of a set-valued record (see SetValidator), signed by its author.
+type SetEntry struct {
+	Value []byte
+	// PublicKey is the marshalled public key of the author of the entry.
+	PublicKey []byte
+	// Signature is the signature of the key and Value.
+	Signature []byte
+}
+
+// Author returns the peer that signed the entry.
+func (e *SetEntry) Author() (peer.ID, error) {
+	pk, err := ci.UnmarshalPublicKey(e.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pk)
+}
+
+func (e *SetEntry) signedBytes(key string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(setEntrySignaturePrefix)
+	writeLengthPrefixed(&buf, []byte(key))
+	buf.Write(e.Value)
+	return buf.Bytes()
+}
+
+func (e *SetEntry) verify(key string) error {
+	pk, err := ci.UnmarshalPublicKey(e.PublicKey)
+	if err != nil {
+		return err
+	}
+	ok, err := pk.Verify(e.signedBytes(key), e.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid set entry signature")
+	}
+	return nil
+}
+
+// id identifies the entry in a set: a set holds at most one entry per author and value.
+func (e *SetEntry) id() string {
+	var buf bytes.Buffer
+	writeLengthPrefixed(&buf, e.PublicKey)
+	buf.Write(e.Value)
+	return buf.String()
+}
+
+// MarshalSetValue encodes the entries of a set-valued record, in a canonical order.
+func MarshalSetValue(entries []SetEntry) []byte {
+	sorted := make([]SetEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].id() < sorted[j].id() })
+
+	var buf bytes.Buffer
+	buf.WriteString(setValuePrefix)
+	writeUvarint(&buf, uint64(len(sorted)))
+	for _, e := range sorted {
+		writeLengthPrefixed(&buf, e.Value)
+		writeLengthPrefixed(&buf, e.PublicKey)
+		writeLengthPrefixed(&buf, e.Signature)
+	}
+	return buf.Bytes()
+}
+
+// UnmarshalSetValue decodes the entries of a set-valued record encoded with MarshalSetValue. It doesn't validate them.
+func UnmarshalSetValue(data []byte) ([]SetEntry, error) {
+	if !bytes.HasPrefix(data, []byte(setValuePrefix)) {
+		return nil, errInvalidSetValue
+	}
+	r := bytes.NewReader(data[len(setValuePrefix):])
+	n, err := binary.ReadUvarint(r)
+	// every entry takes at least three bytes
+	if err != nil || n > uint64(r.Len()) {
+		return nil, errInvalidSetValue
+	}
+	entries := make([]SetEntry, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var e SetEntry
+		var ok bool
+		if e.Value, ok = readLengthPrefixed(r); !ok {
+			return nil, errInvalidSetValue
+		}
+		if e.PublicKey, ok = readLengthPrefixed(r); !ok {
+			return nil, errInvalidSetValue
+		}
+		if e.Signature, ok = readLengthPrefixed(r); !ok {
+			return nil, errInvalidSetValue
+		}
+		entries = append(entries, e)
+	}
+	if r.Len() != 0 {
+		return nil, errInvalidSetValue
+	}
+	return entries, nil
+}
+
+// SetValidator is a MergingValidator for set-valued records: the value of a key is a set of entries signed by their
+// authors, and the sets stored or found for the key are merged into their union, up to MaxEntries entries: adding
+// entries to a full set fails with ErrSetFull. It can be registered for any namespace with NamespacedValidator.
+type SetValidator struct {
+	// MaxEntries is the maximum number of entries of a set, 1024 if 0.
+	MaxEntries int
+}
+
+var _ MergingValidator = SetValidator{}
+
+func (v SetValidator) maxEntries() int {
+	if v.MaxEntries > 0 {
+		return v.MaxEntries
+	}
+	return defaultMaxSetEntries
+}
+
+// Validate checks that the value is a set of at most MaxEntries entries signed by their authors.
+func (v SetValidator) Validate(key string, value []byte) error {
+	entries, err := UnmarshalSetValue(value)
+	if err != nil {
+		return err
+	}
+	if len(entries) > v.maxEntries() {
+		return fmt.Errorf("set has %d entries, more than the maximum of %d", len(entries), v.maxEntries())
+	}
+	for i := range entries {
+		if err := entries[i].verify(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select selects the set with the most entries, it is only used when sets can't be merged.
+func (v SetValidator) Select(_ string, values [][]byte) (int, error) {
+	best, bestLen := -1, -1
+	for i, val := range values {
+		entries, err := UnmarshalSetValue(val)
+		if err != nil {
+			continue
+		}
+		if len(entries) > bestLen {
+			best, bestLen = i, len(entries)
+		}
+	}
+	if best == -1 {
+		return 0, errors.New("no usable set value")
+	}
+	return best, nil
+}
+
+// Merge returns the union of the sets, or ErrSetFull if the union has more than MaxEntries entries.
+func (v SetValidator) Merge(_ string, values [][]byte) ([]byte, error) {
+	var merged []SetEntry
+	seen := make(map[string]struct{})
+	for _, val := range values {
+		entries, err := UnmarshalSetValue(val)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if _, ok := seen[e.id()]; ok {
+				continue
+			}
+			if len(merged) == v.maxEntries() {
+				return nil, ErrSetFull
+			}
+			seen[e.id()] = struct{}{}
+			merged = append(merged, e)
+		}
+	}
+	return MarshalSetValue(merged), nil
+}
+
+// AddSetEntry signs the value with the host's private key and adds it to the set-valued record of the key, with
+// PutValue. The namespace of the key must be validated by SetValidator. It fails with ErrSetFull if the set stored
+// locally is full, and fails if none of the closest peers of the key accepted the entry.
+func (dht *IpfsDHT) AddSetEntry(ctx context.Context, key string, value []byte, opts ...routing.Option) error {
+	sk := dht.peerstore.PrivKey(dht.self)
+	if sk == nil {
+		return errors.New("no private key for this node in the peerstore")
+	}
+	pkbytes, err := ci.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	e := SetEntry{Value: value, PublicKey: pkbytes}
+	if e.Signature, err = sk.Sign(e.signedBytes(key)); err != nil {
+		return err
+	}
+	return dht.PutValue(ctx, key, MarshalSetValue([]SetEntry{e}), opts...)
+}
+
+// GetSetEntries searches for the set-valued record of the key, and returns the union of the entries found.
+func (dht *IpfsDHT) GetSetEntries(ctx context.Context, key string, opts ...routing.Option) ([]SetEntry, error) {
+	data, err := dht.GetValue(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalSetValue(data)
+}
@@ -0,0 +1,257 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/multiformats/go-multihash"
+)
+
+// signedRecordPrefix starts every encoded SignedRecord.
+const signedRecordPrefix = "/dht-signed/1\n"
+
+// signaturePrefix separates the signatures of signed records from the other signatures of the same key.
+const signaturePrefix = "dht-signed-record:"
+
+var errInvalidSignedRecord = errors.New("invalid signed record")
+
+// SignedRecord is the value of a key validated by SignedValidator: a value signed by the peer the key belongs to.
+type SignedRecord struct {
+	// Seq orders the values of the key, the highest one wins.
+	Seq uint64
+	// Expiry is the time after which the record is invalid.
+	Expiry time.Time
+	Value  []byte
+	// PublicKey is the marshalled public key of the peer the key belongs to.
+	PublicKey []byte
+	// Signature is the signature of the key, Seq, Expiry and Value.
+	Signature []byte
+}
+
+// Marshal encodes the record.
+func (r *SignedRecord) Marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(signedRecordPrefix)
+	writeUvarint(&buf, r.Seq)
+	writeUvarint(&buf, uint64(r.Expiry.UnixNano()))
+	writeLengthPrefixed(&buf, r.Value)
+	writeLengthPrefixed(&buf, r.PublicKey)
+	writeLengthPrefixed(&buf, r.Signature)
+	return buf.Bytes()
+}
+
+// UnmarshalSignedRecord decodes a record encoded with SignedRecord.Marshal. It doesn't validate the record.
+func UnmarshalSignedRecord(data []byte) (*SignedRecord, error) {
+	if !bytes.HasPrefix(data, []byte(signedRecordPrefix)) {
+		return nil, errInvalidSignedRecord
+	}
+	r := bytes.NewReader(data[len(signedRecordPrefix):])
+
+	rec := new(SignedRecord)
+	var err error
+	if rec.Seq, err = binary.ReadUvarint(r); err != nil {
+		return nil, errInvalidSignedRecord
+	}
+	expiry, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errInvalidSignedRecord
+	}
+	rec.Expiry = time.Unix(0, int64(expiry))
+	var ok bool
+	if rec.Value, ok = readLengthPrefixed(r); !ok {
+		return nil, errInvalidSignedRecord
+	}
+	if rec.PublicKey, ok = readLengthPrefixed(r); !ok {
+		return nil, errInvalidSignedRecord
+	}
+	if rec.Signature, ok = readLengthPrefixed(r); !ok {
+		return nil, errInvalidSignedRecord
+	}
+	if r.Len() != 0 {
+		return nil, errInvalidSignedRecord
+	}
+	return rec, nil
+}
+
+// signedBytes returns the bytes the signature of the record under the key is computed over.
+func (r *SignedRecord) signedBytes(key string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(signaturePrefix)
+	writeLengthPrefixed(&buf, []byte(key))
+	writeUvarint(&buf, r.Seq)
+	writeUvarint(&buf, uint64(r.Expiry.UnixNano()))
+	buf.Write(r.Value)
+	return buf.Bytes()
+}
+
+// SignedValueKey returns the key of the signed value with the given name of the peer, in the namespace ns. The name
+// may be empty.
+func SignedValueKey(ns string, p peer.ID, name string) string {
+	key := "/" + ns + "/" + string(p)
+	if name != "" {
+		key += "/" + name
+	}
+	return key
+}
+
+// signedValueKeyPeer returns the peer a signed value key belongs to.
+func signedValueKeyPeer(key string) (peer.ID, error) {
+	_, rest, err := record.SplitKey(key)
+	if err != nil {
+		return "", err
+	}
+	n, _, err := multihash.MHFromBytes([]byte(rest))
+	if err != nil {
+		return "", fmt.Errorf("signed value key doesn't start with a peer ID: %w", err)
+	}
+	if n < len(rest) && rest[n] != '/' {
+		return "", errors.New("signed value key doesn't start with a peer ID")
+	}
+	return peer.IDFromBytes([]byte(rest[:n]))
+}
+
+// SignedValidator is a record.Validator for mutable records signed by the peer their key belongs to (see
+// SignedValueKey and PutSignedValue). It can be registered for any namespace with NamespacedValidator.
+type SignedValidator struct{}
+
+var _ record.Validator = SignedValidator{}
+
+// Validate checks that the value is a SignedRecord that didn't expire, signed by the peer of the key.
+func (SignedValidator) Validate(key string, value []byte) error {
+	p, err := signedValueKeyPeer(key)
+	if err != nil {
+		return err
+	}
+	rec, err := UnmarshalSignedRecord(value)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(rec.Expiry) {
+		return errors.New("signed record expired")
+	}
+
+	pk, err := ci.UnmarshalPublicKey(rec.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !p.MatchesPublicKey(pk) {
+		return errors.New("signed record public key doesn't match the peer of the key")
+	}
+	ok, err := pk.Verify(rec.signedBytes(key), rec.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid signed record signature")
+	}
+	return nil
+}
+
+// Select selects the record with the highest sequence number, then with the latest expiry.
+func (SignedValidator) Select(_ string, values [][]byte) (int, error) {
+	best := -1
+	var bestRec *SignedRecord
+	for i, v := range values {
+		rec, err := UnmarshalSignedRecord(v)
+		if err != nil {
+			continue
+		}
+		if bestRec == nil || rec.Seq > bestRec.Seq || (rec.Seq == bestRec.Seq && rec.Expiry.After(bestRec.Expiry)) {
+			best, bestRec = i, rec
+		}
+	}
+	if best == -1 {
+		return 0, errors.New("no usable signed record")
+	}
+	return best, nil
+}
+
+// PutSignedValue signs the value with the host's private key and stores it under the key, that must belong to this
+// node (see SignedValueKey), with PutValue. The value expires after ttl, and supersedes the value currently stored
+// under the key: its sequence number is one more than the one of the current value, found locally or else with
+// GetValue. The namespace of the key must be validated by SignedValidator.
+func (dht *IpfsDHT) PutSignedValue(ctx context.Context, key string, value []byte, ttl time.Duration, opts ...routing.Option) error {
+	if !dht.enableValues {
+		return routing.ErrNotSupported
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("signed value ttl must be positive, got %v", ttl)
+	}
+	p, err := signedValueKeyPeer(key)
+	if err != nil {
+		return err
+	}
+	if p != dht.self {
+		return fmt.Errorf("signed value key belongs to %s, not to this node", p)
+	}
+
+	sk := dht.peerstore.PrivKey(dht.self)
+	if sk == nil {
+		return errors.New("no private key for this node in the peerstore")
+	}
+	pkbytes, err := ci.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+
+	current, err := dht.currentSignedRecord(ctx, key, opts...)
+	if err != nil {
+		return err
+	}
+	rec := &SignedRecord{
+		Expiry:    time.Now().Add(ttl),
+		Value:     value,
+		PublicKey: pkbytes,
+	}
+	if current != nil {
+		rec.Seq = current.Seq + 1
+	}
+	if rec.Signature, err = sk.Sign(rec.signedBytes(key)); err != nil {
+		return err
+	}
+	return dht.PutValue(ctx, key, rec.Marshal(), opts...)
+}
+
+// currentSignedRecord returns the record stored under the key locally or else found with GetValue, nil if none.
+func (dht *IpfsDHT) currentSignedRecord(ctx context.Context, key string, opts ...routing.Option) (*SignedRecord, error) {
+	local, err := dht.getLocal(key)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	if local != nil {
+		value = local.GetValue()
+	} else {
+		value, err = dht.GetValue(ctx, key, opts...)
+		if err == routing.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return UnmarshalSignedRecord(value)
+}
+
+// GetSignedValue searches for the signed value stored under the key with PutSignedValue, and returns the value of the
+// record with the highest sequence number.
+func (dht *IpfsDHT) GetSignedValue(ctx context.Context, key string, opts ...routing.Option) ([]byte, error) {
+	data, err := dht.GetValue(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := UnmarshalSignedRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Value, nil
+}
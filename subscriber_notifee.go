@@ -182,20 +182,11 @@ func (nn *subscriberNotifee) Disconnected(n network.Network, v network.Conn) {
 
 	dht.smlk.Lock()
 	defer dht.smlk.Unlock()
-	ms, ok := dht.strmap[p]
+	ms, ok := dht.removeMessageSender(p)
 	if !ok {
 		return
 	}
-	delete(dht.strmap, p)
-
-	// Do this asynchronously as ms.lk can block for a while.
-	go func() {
-		if err := ms.lk.Lock(dht.Context()); err != nil {
-			return
-		}
-		defer ms.lk.Unlock()
-		ms.invalidate()
-	}()
+	dht.closeMessageSender(ms)
 }
 
 func (nn *subscriberNotifee) Connected(network.Network, network.Conn)      {}
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	u "github.com/ipfs/go-ipfs-util"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	"github.com/multiformats/go-multihash"
+)
+
+// ValueResponse is the value a peer returned to GetValueDetailed.
+type ValueResponse struct {
+	From peer.ID
+	// Value is the value the peer returned, even if it is invalid.
+	Value []byte
+	// Hash is the SHA2-256 multihash of the value.
+	Hash multihash.Multihash
+	// Valid tells whether the value passed the validator of the key.
+	Valid bool
+	// Selected tells whether the value is the one the value resolution strategy selected.
+	Selected bool
+}
+
+// ValueResult is the result of GetValueDetailed.
+type ValueResult struct {
+	// Value is the selected value, nil if no peer returned a valid one.
+	Value []byte
+	// Responses are the values the peers returned, in the order they were received. The local value, if any, comes
+	// first, from this node.
+	Responses []ValueResponse
+	// NotFound are the peers that responded without a value.
+	NotFound []peer.ID
+	// Repairs are the read-repairs of the closest peers to the key that didn't return the selected value, empty if
+	// read-repair is disabled or the search stopped early.
+	Repairs []PeerRepair
+	// Completed tells whether the lookup ran until the Kademlia end condition, rather than being interrupted.
+	Completed bool
+	// Reason is the reason the lookup terminated for, LookupStarvation if no lookup ran, e.g. because the routing
+	// table is empty or the key was recently not found (see NegativeCache).
+	Reason LookupTerminationReason
+	// Elapsed is the duration of the lookup.
+	Elapsed time.Duration
+}
+
+// SelectedFrom returns the peers that returned the selected value.
+func (r *ValueResult) SelectedFrom() []peer.ID {
+	var peers []peer.ID
+	for _, resp := range r.Responses {
+		if resp.Selected {
+			peers = append(peers, resp.From)
+		}
+	}
+	return peers
+}
+
+// valueProvenance records the responses of the peers to a lookup for a value.
+type valueProvenance struct {
+	mu        sync.Mutex
+	responses []ValueResponse
+	notFound  []peer.ID
+}
+
+// record records the first response of a peer, the record being nil if the peer didn't have one. It is a no-op on a
+// nil valueProvenance.
+func (vp *valueProvenance) record(p peer.ID, rec *recpb.Record, err error) {
+	if vp == nil {
+		return
+	}
+
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	// the follow-up of the lookup can query a peer again
+	for _, resp := range vp.responses {
+		if resp.From == p {
+			return
+		}
+	}
+	for _, nf := range vp.notFound {
+		if nf == p {
+			return
+		}
+	}
+
+	if rec == nil || rec.GetValue() == nil {
+		vp.notFound = append(vp.notFound, p)
+		return
+	}
+	vp.responses = append(vp.responses, ValueResponse{
+		From:  p,
+		Value: rec.GetValue(),
+		Hash:  u.Hash(rec.GetValue()),
+		Valid: err == nil,
+	})
+}
+
+// GetValueDetailed searches for the value corresponding to the given key, like GetValue, and reports what every peer
+// responded along with the selected value: this tells which peers disagree on the value of a key and why. The value
+// resolution strategy can be chosen like with SearchValue.
+//
+// Unlike GetValue, the lookup is never shared with concurrent calls for the same key.
+func (dht *IpfsDHT) GetValueDetailed(ctx context.Context, key string, opts ...routing.Option) (*ValueResult, error) {
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return nil, err
+	}
+	responsesNeeded := getQuorum(&cfg, defaultQuorum)
+
+	start := time.Now()
+	prov := new(valueProvenance)
+	stopCh := make(chan struct{})
+	valCh, lookupResCh := dht.getValuesUnshared(ctx, key, stopCh, prov, opts...)
+
+	rv := dht.resolveValue(ctx, key, getValueResolution(&cfg), responsesNeeded, valCh, lookupResCh, stopCh, nil)
+	// peers are only repaired if the search didn't stop early, like with SearchValue
+	res := &ValueResult{Value: rv.val, Repairs: dht.readRepair(key, rv, true)}
+
+	lookupRes := rv.lookupRes
+	if lookupRes == nil {
+		// wait for the lookup to end, the responses received after the search stopped are still recorded
+		for range valCh {
+		}
+		lookupRes = <-lookupResCh
+	}
+	res.Elapsed = time.Since(start)
+
+	prov.mu.Lock()
+	res.Responses = prov.responses
+	res.NotFound = prov.notFound
+	prov.mu.Unlock()
+
+	for i := range res.Responses {
+		_, ok := rv.peers[res.Responses[i].From]
+		res.Responses[i].Selected = ok && res.Responses[i].Valid
+	}
+
+	switch {
+	case lookupRes != nil:
+		res.Completed = lookupRes.completed
+		res.Reason = lookupRes.reason
+	case ctx.Err() != nil:
+		res.Reason = LookupCancelled
+	default:
+		res.Reason = LookupStarvation
+	}
+
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	if rv.val == nil {
+		return res, routing.ErrNotFound
+	}
+	return res, nil
+}
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// resolvedValue is the value a search for a value resolved.
+type resolvedValue struct {
+	// val is nil if the search didn't resolve a value.
+	val []byte
+	// peers are the peers that returned the value.
+	peers map[peer.ID]struct{}
+	// lookupRes is the result of the lookup, nil if the search stopped early.
+	lookupRes *lookupWithFollowupResult
+}
+
+// resolveValue resolves the values of a search for the key read from valCh according to the strategy (see
+// FirstValidValue, QuorumAgreement, FreshestValue and ClosestPeersValue, and Quorum for the default strategy). The
+// values to return are sent on out, if not nil, and stopCh is closed once the search can stop. The peers that
+// returned an outdated value or the resolved one are recorded (see StaleValueCount).
+func (dht *IpfsDHT) resolveValue(ctx context.Context, key string, strategy valueResolution, nvals int,
+	valCh <-chan RecvdVal, lookupResCh <-chan *lookupWithFollowupResult, stopCh chan struct{}, out chan<- []byte) *resolvedValue {
+	peersByValue := make(map[string]map[peer.ID]struct{})
+	var rv *resolvedValue
+	if strategy.mode == resolveClosestPeers {
+		rv = dht.resolveClosestPeersValue(ctx, key, valCh, lookupResCh, out, peersByValue)
+	} else {
+		rv = dht.resolveValueWithStrategy(ctx, key, strategy, nvals, valCh, lookupResCh, stopCh, out, peersByValue)
+	}
+
+	if rv.val != nil {
+		var stale []peer.ID
+		for val, peers := range peersByValue {
+			if val == string(rv.val) {
+				continue
+			}
+			if sel, err := dht.Validator.Select(key, [][]byte{rv.val, []byte(val)}); err != nil || sel != 0 {
+				continue
+			}
+			for p := range peers {
+				if _, ok := rv.peers[p]; !ok {
+					stale = append(stale, p)
+				}
+			}
+		}
+		dht.recordStaleValues(rv.peers, stale)
+	}
+	return rv
+}
+
+// addValue records that the peer returned the value, and returns the peers that returned it.
+func addValue(peersByValue map[string]map[peer.ID]struct{}, v RecvdVal) map[peer.ID]struct{} {
+	peers, ok := peersByValue[string(v.Val)]
+	if !ok {
+		peers = make(map[peer.ID]struct{})
+		peersByValue[string(v.Val)] = peers
+	}
+	peers[v.From] = struct{}{}
+	return peers
+}
+
+func (dht *IpfsDHT) resolveValueWithStrategy(ctx context.Context, key string, strategy valueResolution, nvals int,
+	valCh <-chan RecvdVal, lookupResCh <-chan *lookupWithFollowupResult, stopCh chan struct{}, out chan<- []byte,
+	peersByValue map[string]map[peer.ID]struct{}) *resolvedValue {
+
+	send := func(ctx context.Context, val []byte) bool {
+		if out == nil {
+			return true
+		}
+		select {
+		case out <- val:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	stop := func() bool {
+		close(stopCh)
+		return true
+	}
+
+	var resolved, freshest []byte
+	numResponses := 0
+	// a peer can respond twice if the follow-up of the lookup queries it again
+	responded := make(map[peer.ID]struct{})
+	best, peersWithBest, aborted := dht.processValues(ctx, key, valCh,
+		func(ctx context.Context, v RecvdVal, better bool) bool {
+			numResponses++
+			responded[v.From] = struct{}{}
+			peers := addValue(peersByValue, v)
+
+			switch strategy.mode {
+			case resolveFirstValid:
+				// the local value isn't validated on the way
+				if err := dht.Validator.Validate(key, v.Val); err != nil {
+					return false
+				}
+				resolved = v.Val
+			case resolveQuorumAgreement:
+				if len(peers) < strategy.n {
+					return false
+				}
+				resolved = v.Val
+			case resolveFreshest:
+				if better {
+					freshest = v.Val
+				}
+				if len(responded) < strategy.n {
+					return false
+				}
+				resolved = freshest
+			default:
+				if better && !send(ctx, v.Val) {
+					return false
+				}
+				if nvals > 0 && numResponses > nvals {
+					return stop()
+				}
+				return false
+			}
+
+			send(ctx, resolved)
+			return stop()
+		})
+
+	if aborted {
+		if strategy.mode == resolveBest {
+			return &resolvedValue{val: best, peers: peersWithBest}
+		}
+		return &resolvedValue{val: resolved, peers: peersByValue[string(resolved)]}
+	}
+	if strategy.mode != resolveBest || best == nil {
+		// the strategy didn't resolve a value before the lookup ended
+		return &resolvedValue{}
+	}
+
+	rv := &resolvedValue{val: best, peers: peersWithBest}
+	select {
+	case rv.lookupRes = <-lookupResCh:
+	case <-ctx.Done():
+	}
+	return rv
+}
+
+// resolveClosestPeersValue resolves the best value among the values of the K closest peers the lookup found, and of
+// this node if it is closer than the furthest of them.
+func (dht *IpfsDHT) resolveClosestPeersValue(ctx context.Context, key string, valCh <-chan RecvdVal,
+	lookupResCh <-chan *lookupWithFollowupResult, out chan<- []byte, peersByValue map[string]map[peer.ID]struct{}) *resolvedValue {
+	var vals []RecvdVal
+	dht.processValues(ctx, key, valCh, func(_ context.Context, v RecvdVal, _ bool) bool {
+		vals = append(vals, v)
+		return false
+	})
+
+	var lookupRes *lookupWithFollowupResult
+	select {
+	case lookupRes = <-lookupResCh:
+	case <-ctx.Done():
+	}
+	if lookupRes == nil {
+		return &resolvedValue{}
+	}
+
+	closest := make(map[peer.ID]struct{}, len(lookupRes.peers)+1)
+	for _, p := range lookupRes.peers {
+		closest[p] = struct{}{}
+	}
+	if n := len(lookupRes.peers); n == 0 || kb.Closer(dht.self, lookupRes.peers[n-1], key) {
+		closest[dht.self] = struct{}{}
+	}
+
+	var best []byte
+	var peersWithBest map[peer.ID]struct{}
+	for _, v := range vals {
+		if _, ok := closest[v.From]; !ok {
+			continue
+		}
+		addValue(peersByValue, v)
+		if best != nil {
+			if bytes.Equal(best, v.Val) {
+				peersWithBest[v.From] = struct{}{}
+				continue
+			}
+			if sel, err := dht.Validator.Select(key, [][]byte{best, v.Val}); err != nil || sel != 1 {
+				continue
+			}
+		}
+		best = v.Val
+		peersWithBest = map[peer.ID]struct{}{v.From: {}}
+	}
+
+	if best != nil && out != nil {
+		select {
+		case out <- best:
+		case <-ctx.Done():
+		}
+	}
+	return &resolvedValue{val: best, peers: peersWithBest, lookupRes: lookupRes}
+}
@@ -0,0 +1,218 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/routing"
+)
+
+// maxWatchValueBackoff bounds the delay between the searches of a watcher whose value doesn't change, as a multiple of
+// its interval.
+const maxWatchValueBackoff = 16
+
+// valueWatchers shares a single watcher among the subscribers to the same key.
+type valueWatchers struct {
+	mu       sync.Mutex
+	watchers map[string]*valueWatcher
+}
+
+func newValueWatchers() *valueWatchers {
+	return &valueWatchers{watchers: make(map[string]*valueWatcher)}
+}
+
+// valueWatcher periodically searches for the value of a key and sends the newer values to its subscribers.
+type valueWatcher struct {
+	key string
+
+	// ctx is cancelled once all subscribers left.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// wake resets the backoff once a subscriber with a shorter interval joined.
+	wake chan struct{}
+
+	mu       sync.Mutex
+	interval time.Duration
+	latest   []byte
+	subs     map[chan []byte]struct{}
+}
+
+// WatchValue watches the value of a mutable record, and returns a channel of its new best values: the best value found
+// by a first search, then every value the validator selects over the previous one. Values that are not strictly newer
+// are not sent, and a subscriber that doesn't keep up only receives the latest value.
+//
+// The value is searched for every interval with SearchValue, backing off up to 16 times the interval while it doesn't
+// change. Concurrent watchers of the same key share the searches, at the shortest of their intervals. The channel is
+// closed once the context is done or the DHT is closed.
+func (dht *IpfsDHT) WatchValue(ctx context.Context, key string, interval time.Duration) (<-chan []byte, error) {
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("watch interval must be positive, got %v", interval)
+	}
+
+	ch := make(chan []byte, 1)
+	w := dht.valueWatchers.subscribe(dht, key, interval, ch)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.ctx.Done():
+		}
+		dht.valueWatchers.unsubscribe(w, ch)
+	}()
+	return ch, nil
+}
+
+// subscribe adds a subscriber to the watcher of the key, starting one if needed.
+func (s *valueWatchers) subscribe(dht *IpfsDHT, key string, interval time.Duration, ch chan []byte) *valueWatcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.watchers[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(dht.ctx)
+		w = &valueWatcher{
+			key:      key,
+			ctx:      ctx,
+			cancel:   cancel,
+			wake:     make(chan struct{}, 1),
+			interval: interval,
+			subs:     make(map[chan []byte]struct{}),
+		}
+		s.watchers[key] = w
+		go dht.watchValue(w)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs[ch] = struct{}{}
+	if w.latest != nil {
+		ch <- w.latest
+	}
+	if interval < w.interval {
+		w.interval = interval
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return w
+}
+
+// unsubscribe removes a subscriber and closes its channel, stopping the watcher once it has no subscribers left.
+func (s *valueWatchers) unsubscribe(w *valueWatcher, ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subs[ch]; !ok {
+		return
+	}
+	delete(w.subs, ch)
+	close(ch)
+	if len(w.subs) == 0 {
+		w.cancel()
+		s.remove(w)
+	}
+}
+
+// remove must be called with the lock held.
+func (s *valueWatchers) remove(w *valueWatcher) {
+	if s.watchers[w.key] == w {
+		delete(s.watchers, w.key)
+	}
+}
+
+// stop closes the channels of the remaining subscribers once the watcher stopped.
+func (s *valueWatchers) stop(w *valueWatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.subs {
+		close(ch)
+	}
+	w.subs = nil
+	s.remove(w)
+}
+
+func (dht *IpfsDHT) watchValue(w *valueWatcher) {
+	defer dht.valueWatchers.stop(w)
+
+	var delay time.Duration
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-w.wake:
+			timer.Stop()
+		case <-w.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		changed := dht.pollValue(w)
+
+		w.mu.Lock()
+		interval := w.interval
+		w.mu.Unlock()
+		if changed || delay < interval {
+			delay = interval
+		} else {
+			delay *= 2
+			if delay > maxWatchValueBackoff*interval {
+				delay = maxWatchValueBackoff * interval
+			}
+		}
+		select {
+		case <-w.wake:
+			delay = interval
+		default:
+		}
+	}
+}
+
+// pollValue searches for the value of the watched key, and sends it to the subscribers if it is newer than the last one
+// they received. It returns true if it sent a value.
+func (dht *IpfsDHT) pollValue(w *valueWatcher) bool {
+	valCh, err := dht.SearchValue(w.ctx, w.key)
+	if err != nil {
+		logger.Debugw("failed to search for watched value", "key", loggableRecordKeyString(w.key), "error", err)
+		return false
+	}
+	var best []byte
+	for val := range valCh {
+		best = val
+	}
+	if best == nil || w.ctx.Err() != nil {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.latest != nil {
+		if bytes.Equal(w.latest, best) {
+			return false
+		}
+		if sel, err := dht.Validator.Select(w.key, [][]byte{w.latest, best}); err != nil || sel != 1 {
+			return false
+		}
+	}
+	w.latest = best
+	for ch := range w.subs {
+		// replace the value the subscriber didn't receive yet, if any
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- best
+	}
+	return true
+}